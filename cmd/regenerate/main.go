@@ -0,0 +1,108 @@
+// Command regenerate re-processes thumbnails and other derivatives of
+// existing images, e.g. after the thumbnail settings have changed.
+//
+// By default only images processed with different thumbnail settings are
+// selected. Progress is printed after every batch together with a cursor;
+// pass it back with -after to resume an interrupted run.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	"github.com/mzzz-zzm/galleryblue/internal/imaging"
+	"github.com/mzzz-zzm/galleryblue/internal/jobs"
+)
+
+func main() {
+	owner := flag.String("owner", "", "only images owned by this user ID")
+	since := flag.String("since", "", "only images created at or after this time (RFC 3339)")
+	until := flag.String("until", "", "only images created before this time (RFC 3339)")
+	status := flag.String("status", "", "only images with this processing status (pending, processing, ready, failed)")
+	all := flag.Bool("all", false, "include images already processed with the current settings")
+	after := flag.String("after", "", "resume after this image ID (cursor from a previous run)")
+	batch := flag.Int("batch", 100, "images per batch")
+	dryRun := flag.Bool("dry-run", false, "list what would be processed without changing anything")
+	enqueue := flag.Bool("enqueue", false, "queue jobs for the server's workers instead of processing here")
+	flag.Parse()
+
+	if *owner != "" && !db.ValidUUID(*owner) {
+		log.Fatalf("Invalid -owner: %q is not an ID", *owner)
+	}
+	if *after != "" && !db.ValidUUID(*after) {
+		log.Fatalf("Invalid -after: %q is not an ID", *after)
+	}
+
+	filter := db.RegenerateFilter{
+		OwnerID:          *owner,
+		ProcessingStatus: *status,
+		After:            *after,
+	}
+	if !*all {
+		filter.StaleSpec = jobs.ThumbnailSpec
+	}
+	var err error
+	if filter.CreatedAfter, err = parseTime(*since); err != nil {
+		log.Fatalf("Invalid -since: %v", err)
+	}
+	if filter.CreatedBefore, err = parseTime(*until); err != nil {
+		log.Fatalf("Invalid -until: %v", err)
+	}
+
+	if err := db.Init(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	if err := imaging.Init(); err != nil {
+		log.Fatalf("Failed to configure image decoding: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	start := time.Now()
+	progress, err := jobs.Regenerate(ctx, jobs.RegenerateOptions{
+		Filter:    filter,
+		BatchSize: *batch,
+		DryRun:    *dryRun,
+		Inline:    !*enqueue,
+	}, func(p jobs.RegenerateProgress) error {
+		fmt.Printf("%d/%d images (%d failed), cursor %s\n", p.Done, p.Total, p.Failed, p.Cursor)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Stopped: %v", err)
+		if progress.Cursor != "" {
+			log.Printf("Resume with -after %s", progress.Cursor)
+		}
+		os.Exit(1)
+	}
+
+	verb := "processed"
+	switch {
+	case *dryRun:
+		verb = "would process"
+	case *enqueue:
+		verb = "queued"
+	}
+	fmt.Printf("Done: %s %d images (%d failed) in %s\n", verb, progress.Done, progress.Failed, time.Since(start).Round(time.Millisecond))
+}
+
+// parseTime parses an optional RFC 3339 timestamp
+func parseTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/rs/cors"
 	"golang.org/x/net/http2"
@@ -12,6 +14,8 @@ import (
 	"github.com/mzzz-zzm/galleryblue/gen/go/users/v1/usersv1connect"
 	"github.com/mzzz-zzm/galleryblue/internal/db"
 	"github.com/mzzz-zzm/galleryblue/internal/handlers"
+	"github.com/mzzz-zzm/galleryblue/internal/imaging"
+	"github.com/mzzz-zzm/galleryblue/internal/jobs"
 )
 
 func main() {
@@ -21,6 +25,21 @@ func main() {
 	}
 	defer db.Close()
 
+	// Apply the full-text search language
+	if err := db.InitSearch(context.Background()); err != nil {
+		log.Fatalf("Failed to configure search: %v", err)
+	}
+
+	// Configure image decode limits
+	if err := imaging.Init(); err != nil {
+		log.Fatalf("Failed to configure image decoding: %v", err)
+	}
+
+	// Start background job workers
+	if err := jobs.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start job workers: %v", err)
+	}
+
 	mux := http.NewServeMux()
 
 	// Register AuthService handler
@@ -35,6 +54,24 @@ func main() {
 	imagePath, imageHandler := usersv1connect.NewImageServiceHandler(&handlers.ImageServer{})
 	mux.Handle(imagePath, imageHandler)
 
+	// Register AlbumService handler
+	albumPath, albumHandler := usersv1connect.NewAlbumServiceHandler(&handlers.AlbumServer{})
+	mux.Handle(albumPath, albumHandler)
+
+	// Register ShareService handler
+	sharePath, shareHandler := usersv1connect.NewShareServiceHandler(&handlers.ShareServer{
+		BaseURL: os.Getenv("SHARE_BASE_URL"),
+	})
+	mux.Handle(sharePath, shareHandler)
+
+	// Register CommentService handler
+	commentPath, commentHandler := usersv1connect.NewCommentServiceHandler(&handlers.CommentServer{})
+	mux.Handle(commentPath, commentHandler)
+
+	// Register AdminService handler
+	adminPath, adminHandler := usersv1connect.NewAdminServiceHandler(&handlers.AdminServer{})
+	mux.Handle(adminPath, adminHandler)
+
 	// Add CORS support
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins: []string{"http://localhost:5173", "http://localhost:3000"},
@@ -8,8 +8,9 @@ require (
 	github.com/lib/pq v1.10.9
 	github.com/rs/cors v1.10.1
 	golang.org/x/crypto v0.14.0
+	golang.org/x/image v0.18.0
 	golang.org/x/net v0.17.0
 	google.golang.org/protobuf v1.31.0
 )
 
-require golang.org/x/text v0.13.0 // indirect
+require golang.org/x/text v0.16.0 // indirect
@@ -8,6 +8,9 @@ CREATE TABLE IF NOT EXISTS users (
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
     display_name VARCHAR(255),
+    metadata_privacy VARCHAR(20) NOT NULL DEFAULT 'strip_location',  -- default for new uploads
+    default_visibility VARCHAR(20) NOT NULL DEFAULT 'public',  -- default for new uploads
+    role VARCHAR(20) NOT NULL DEFAULT 'user',  -- user, admin
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
@@ -15,19 +18,347 @@ CREATE TABLE IF NOT EXISTS users (
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
 CREATE INDEX IF NOT EXISTS idx_users_display_name ON users(display_name);
 
+-- Storage limits by role; NULL (or no row) is unlimited
+CREATE TABLE IF NOT EXISTS role_quotas (
+    role VARCHAR(20) PRIMARY KEY,
+    max_bytes BIGINT CHECK (max_bytes > 0),
+    max_images INTEGER CHECK (max_images > 0)
+);
+
+INSERT INTO role_quotas (role, max_bytes, max_images) VALUES ('user', 1073741824, 5000)
+ON CONFLICT DO NOTHING;
+
+-- Per-user limits set by an admin, replacing both of the role's limits;
+-- NULL is unlimited
+CREATE TABLE IF NOT EXISTS user_quotas (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    max_bytes BIGINT CHECK (max_bytes > 0),
+    max_images INTEGER CHECK (max_images > 0),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Content-addressed image bytes, shared by all images with identical content
+CREATE TABLE IF NOT EXISTS blobs (
+    sha256 CHAR(64) PRIMARY KEY,
+    data BYTEA NOT NULL,
+    size INTEGER NOT NULL,
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- Images table
 CREATE TABLE IF NOT EXISTS images (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     filename VARCHAR(255) NOT NULL,
     content_type VARCHAR(100) NOT NULL,
-    data BYTEA NOT NULL,
+    blob_sha256 CHAR(64) NOT NULL REFERENCES blobs(sha256),
+    upload_sha256 CHAR(64) NOT NULL,  -- hash of the bytes as uploaded, for duplicate detection
     thumbnail BYTEA,
     title VARCHAR(255),
     description TEXT,
+    metadata_privacy VARCHAR(20),  -- NULL inherits the owner's default
+    visibility VARCHAR(20) NOT NULL DEFAULT 'public',  -- public, unlisted, private
+    width INTEGER,
+    height INTEGER,
+    processing_status VARCHAR(20) NOT NULL DEFAULT 'pending',  -- pending, processing, ready, failed
+    processing_error TEXT,
+    thumbnail_spec VARCHAR(50),  -- thumbnail settings used; differs from current when stale
+    phash BIGINT,  -- 64-bit perceptual (difference) hash of the upright image
+    blurhash VARCHAR(64),  -- placeholders shown while the thumbnail loads
+    lqip TEXT,             -- tiny JPEG data URI
+    palette TEXT[],        -- dominant colors as #rrggbb, most common first
+    dominant_color VARCHAR(10),  -- named bucket of palette[1], for filtering
+    view_count BIGINT NOT NULL DEFAULT 0,  -- views by anyone but the owner
+    like_count INTEGER NOT NULL DEFAULT 0,  -- maintained by triggers on image_likes
+    comments_disabled BOOLEAN NOT NULL DEFAULT false,  -- set by the owner to stop new comments
+    deleted_at TIMESTAMP WITH TIME ZONE,  -- set while in the owner's trash
+    content_version INTEGER NOT NULL DEFAULT 1,  -- bumped each time the content is replaced
+    content_updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    metadata_version INTEGER NOT NULL DEFAULT 0,  -- latest image_revisions version
+    edits JSONB,  -- non-destructive edit recipe applied when rendering; NULL for none
+    search_vector TSVECTOR,  -- maintained by triggers; see image_search_vector
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
 CREATE INDEX IF NOT EXISTS idx_images_owner ON images(owner_id);
 CREATE INDEX IF NOT EXISTS idx_images_created ON images(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_images_public ON images(created_at DESC, id DESC) WHERE visibility = 'public' AND deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_images_owner_created ON images(owner_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_images_public_views ON images(view_count DESC, id DESC) WHERE visibility = 'public' AND deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_images_public_likes ON images(like_count DESC, id DESC) WHERE visibility = 'public' AND deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_images_public_color ON images(dominant_color, created_at DESC, id DESC) WHERE visibility = 'public' AND deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_images_trash ON images(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_images_owner_upload ON images(owner_id, upload_sha256);
+CREATE INDEX IF NOT EXISTS idx_images_blob ON images(blob_sha256);
+
+-- Last counted view of an image by each viewer (a user ID, or "ip:" and the
+-- address of an anonymous one); repeat views within a window aren't counted
+CREATE TABLE IF NOT EXISTS image_views (
+    image_id UUID NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    viewer VARCHAR(100) NOT NULL,
+    viewed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (image_id, viewer)
+);
+
+-- Earlier content of images whose content was replaced. Each row holds its
+-- own reference to the blob.
+CREATE TABLE IF NOT EXISTS image_versions (
+    image_id UUID NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    blob_sha256 CHAR(64) NOT NULL REFERENCES blobs(sha256),
+    upload_sha256 CHAR(64) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    width INTEGER,
+    height INTEGER,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,  -- when this version became current
+    replaced_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (image_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS idx_image_versions_blob ON image_versions(blob_sha256);
+
+-- Snapshot of an image's metadata after each change, starting at upload
+CREATE TABLE IF NOT EXISTS image_revisions (
+    image_id UUID NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    edited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    title VARCHAR(255),
+    description TEXT,
+    metadata_privacy VARCHAR(20),
+    visibility VARCHAR(20) NOT NULL,
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (image_id, version)
+);
+
+-- Images users have liked; images.like_count counts the rows per image
+CREATE TABLE IF NOT EXISTS image_likes (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    image_id UUID NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (user_id, image_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_image_likes_user_created ON image_likes(user_id, created_at DESC, image_id);
+
+-- Keeps like_count in step with every insert and delete, including those
+-- cascading from deleted users
+CREATE OR REPLACE FUNCTION image_likes_count() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        UPDATE images SET like_count = like_count + 1 WHERE id = NEW.image_id;
+    ELSE
+        UPDATE images SET like_count = like_count - 1 WHERE id = OLD.image_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER image_likes_count
+    AFTER INSERT OR DELETE ON image_likes
+    FOR EACH ROW EXECUTE FUNCTION image_likes_count();
+
+-- Free-form tags, normalized to lowercase by the API
+CREATE TABLE IF NOT EXISTS tags (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(50) NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_tags_name_prefix ON tags(name text_pattern_ops);
+
+CREATE TABLE IF NOT EXISTS image_tags (
+    image_id UUID NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    tag_id UUID NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    PRIMARY KEY (image_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_image_tags_tag ON image_tags(tag_id, image_id);
+
+-- Full-text search. The text search configuration (language) is set by the
+-- server from SEARCH_LANGUAGE; changing it re-indexes every image.
+CREATE TABLE IF NOT EXISTS search_settings (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),  -- single row
+    config REGCONFIG NOT NULL DEFAULT 'english'
+);
+
+INSERT INTO search_settings DEFAULT VALUES ON CONFLICT DO NOTHING;
+
+CREATE INDEX IF NOT EXISTS idx_images_search ON images USING GIN(search_vector);
+
+-- Weighted document for an image: title (A), tags (B), description (C),
+-- owner name (D)
+CREATE OR REPLACE FUNCTION image_search_vector(img_id UUID) RETURNS TSVECTOR AS $$
+    SELECT setweight(to_tsvector(s.config, COALESCE(i.title, '')), 'A') ||
+           setweight(to_tsvector(s.config, COALESCE((
+               SELECT string_agg(t.name, ' ') FROM image_tags it JOIN tags t ON it.tag_id = t.id
+               WHERE it.image_id = i.id
+           ), '')), 'B') ||
+           setweight(to_tsvector(s.config, COALESCE(i.description, '')), 'C') ||
+           setweight(to_tsvector(s.config, COALESCE(u.display_name, '')), 'D')
+    FROM images i
+    JOIN users u ON i.owner_id = u.id
+    CROSS JOIN search_settings s
+    WHERE i.id = img_id
+$$ LANGUAGE SQL STABLE;
+
+CREATE OR REPLACE FUNCTION images_search_refresh() RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE images SET search_vector = image_search_vector(NEW.id) WHERE id = NEW.id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Only fires for the indexed columns, so the UPDATE above doesn't recurse
+CREATE OR REPLACE TRIGGER images_search_update
+    AFTER INSERT OR UPDATE OF title, description, owner_id ON images
+    FOR EACH ROW EXECUTE FUNCTION images_search_refresh();
+
+CREATE OR REPLACE FUNCTION image_tags_search_refresh() RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE images SET search_vector = image_search_vector(id)
+    WHERE id IN (SELECT image_id FROM changed_rows);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER image_tags_search_insert
+    AFTER INSERT ON image_tags REFERENCING NEW TABLE AS changed_rows
+    FOR EACH STATEMENT EXECUTE FUNCTION image_tags_search_refresh();
+
+CREATE OR REPLACE TRIGGER image_tags_search_delete
+    AFTER DELETE ON image_tags REFERENCING OLD TABLE AS changed_rows
+    FOR EACH STATEMENT EXECUTE FUNCTION image_tags_search_refresh();
+
+CREATE OR REPLACE FUNCTION users_search_refresh() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.display_name IS DISTINCT FROM OLD.display_name THEN
+        UPDATE images SET search_vector = image_search_vector(id) WHERE owner_id = NEW.id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER users_search_update
+    AFTER UPDATE OF display_name ON users
+    FOR EACH ROW EXECUTE FUNCTION users_search_refresh();
+
+-- Albums group images; an image can be in any number of albums
+CREATE TABLE IF NOT EXISTS albums (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title VARCHAR(255) NOT NULL,
+    description TEXT,
+    cover_image_id UUID REFERENCES images(id) ON DELETE SET NULL,  -- NULL uses the first image
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_albums_owner ON albums(owner_id, updated_at DESC);
+
+CREATE TABLE IF NOT EXISTS album_images (
+    album_id UUID NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+    image_id UUID NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,  -- display order within the album
+    added_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    added_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (album_id, image_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_album_images_position ON album_images(album_id, position);
+CREATE INDEX IF NOT EXISTS idx_album_images_image ON album_images(image_id);
+
+-- Users an album is shared with. Invitations become active once accepted.
+CREATE TABLE IF NOT EXISTS album_members (
+    album_id UUID NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL,  -- viewer, contributor, editor
+    status VARCHAR(20) NOT NULL DEFAULT 'invited',  -- invited, active
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    accepted_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (album_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_album_members_user ON album_members(user_id, status);
+
+-- Unguessable links giving anyone who holds them access to one image or album
+CREATE TABLE IF NOT EXISTS share_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    token VARCHAR(64) NOT NULL UNIQUE,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    image_id UUID REFERENCES images(id) ON DELETE CASCADE,
+    album_id UUID REFERENCES albums(id) ON DELETE CASCADE,
+    password_hash VARCHAR(255),  -- bcrypt; NULL if no password
+    expires_at TIMESTAMP WITH TIME ZONE,  -- NULL never expires
+    max_views INTEGER,  -- NULL is unlimited
+    view_count INTEGER NOT NULL DEFAULT 0,
+    last_accessed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CHECK ((image_id IS NULL) <> (album_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_links_creator ON share_links(created_by, created_at DESC);
+
+-- Browsing sessions started by opening an album through a share link
+CREATE TABLE IF NOT EXISTS share_link_sessions (
+    token VARCHAR(64) PRIMARY KEY,
+    link_id UUID NOT NULL REFERENCES share_links(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_link_sessions_expiry ON share_link_sessions(expires_at);
+
+-- Comments on images, with one level of replies (parent_id is always a
+-- top-level comment). A deleted comment that still has replies keeps its
+-- row, emptied, so the thread stays intact.
+CREATE TABLE IF NOT EXISTS comments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    image_id UUID NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    parent_id UUID REFERENCES comments(id) ON DELETE CASCADE,
+    author_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    body TEXT NOT NULL,  -- cleaned Markdown subset; rendered when read
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    edited_at TIMESTAMP WITH TIME ZONE,
+    deleted_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_comments_image ON comments(image_id, created_at, id) WHERE parent_id IS NULL;
+CREATE INDEX IF NOT EXISTS idx_comments_parent ON comments(parent_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_comments_author ON comments(author_id, created_at DESC);
+
+-- Watermarks drawn on images served to anyone but the owner. A user's own
+-- watermark takes precedence over the site-wide one (user_id NULL).
+CREATE TABLE IF NOT EXISTS watermarks (
+    user_id UUID UNIQUE NULLS NOT DISTINCT REFERENCES users(id) ON DELETE CASCADE,
+    text VARCHAR(100),  -- exactly one of text and image is set
+    image BYTEA,        -- PNG or JPEG logo
+    position VARCHAR(20) NOT NULL DEFAULT 'bottom_right',  -- top_left, top_right, bottom_left, bottom_right, center
+    opacity REAL NOT NULL DEFAULT 0.5,
+    scale REAL NOT NULL DEFAULT 0.2,  -- width as a fraction of the image width
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CHECK ((text IS NULL) <> (image IS NULL))
+);
+
+-- Background jobs (claimed by workers with FOR UPDATE SKIP LOCKED)
+CREATE TABLE IF NOT EXISTS jobs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    kind VARCHAR(50) NOT NULL,
+    image_id UUID REFERENCES images(id) ON DELETE CASCADE,
+    payload JSONB NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',  -- pending, running, done, dead
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 5,
+    last_error TEXT,
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_runnable ON jobs(run_at) WHERE status IN ('pending', 'running');
+CREATE INDEX IF NOT EXISTS idx_jobs_image ON jobs(image_id);
@@ -0,0 +1,208 @@
+// Package authz decides what a user may do with images and albums. Handlers
+// should ask it rather than comparing owner IDs themselves.
+package authz
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+)
+
+var (
+	// ErrNotFound is returned when the resource does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when the user may not perform the action
+	ErrForbidden = errors.New("permission denied")
+)
+
+// Role is a user's level of access to a resource. Higher roles include
+// every permission of the lower ones.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleContributor
+	RoleEditor
+	RoleOwner
+)
+
+// Action is something a user can do to a resource
+type Action string
+
+// Image actions
+const (
+	// ImageView needs RoleViewer for private images only; see Image
+	ImageView   Action = "image.view"
+	ImageEdit   Action = "image.edit"
+	ImageDelete Action = "image.delete"
+	ImageShare  Action = "image.share"
+	// ImageRestore takes an image out of the trash; every other action
+	// treats trashed images as missing
+	ImageRestore Action = "image.restore"
+	// ImageModerate turns comments off and deletes other users' comments
+	ImageModerate Action = "image.moderate"
+)
+
+// Album actions
+const (
+	AlbumView Action = "album.view"
+	// AlbumAddImages adds the user's own images
+	AlbumAddImages Action = "album.add_images"
+	// AlbumRemoveOwnImages removes images the user added
+	AlbumRemoveOwnImages Action = "album.remove_own_images"
+	// AlbumArrange removes any image, reorders images and sets the cover
+	AlbumArrange       Action = "album.arrange"
+	AlbumEdit          Action = "album.edit"
+	AlbumDelete        Action = "album.delete"
+	AlbumManageMembers Action = "album.manage_members"
+	AlbumShare         Action = "album.share"
+)
+
+// policy maps each action to the minimum role needed to perform it
+var policy = map[Action]Role{
+	ImageView:     RoleViewer,
+	ImageEdit:     RoleOwner,
+	ImageDelete:   RoleOwner,
+	ImageShare:    RoleOwner,
+	ImageRestore:  RoleOwner,
+	ImageModerate: RoleOwner,
+
+	AlbumView:            RoleViewer,
+	AlbumAddImages:       RoleContributor,
+	AlbumRemoveOwnImages: RoleContributor,
+	AlbumArrange:         RoleEditor,
+	AlbumEdit:            RoleOwner,
+	AlbumDelete:          RoleOwner,
+	AlbumManageMembers:   RoleOwner,
+	AlbumShare:           RoleOwner,
+}
+
+// Can reports whether role permits action
+func (r Role) Can(action Action) bool {
+	min, ok := policy[action]
+	return ok && r >= min
+}
+
+// MemberRole converts an album member role stored in the database
+func MemberRole(role string) Role {
+	switch role {
+	case db.AlbumRoleViewer:
+		return RoleViewer
+	case db.AlbumRoleContributor:
+		return RoleContributor
+	case db.AlbumRoleEditor:
+		return RoleEditor
+	}
+	return RoleNone
+}
+
+// ImageRole returns userID's role on an image and the image's visibility.
+// The owner gets RoleOwner; users who can see the image through an album
+// (as its owner or a member) get RoleViewer. Anonymous users (userID "")
+// get RoleNone.
+func ImageRole(ctx context.Context, userID, imageID string) (Role, string, error) {
+	access, err := db.GetImageAccess(ctx, imageID, userID)
+	if err != nil {
+		return RoleNone, "", err
+	}
+	if access == nil || access.Trashed {
+		return RoleNone, "", ErrNotFound
+	}
+	return imageRole(userID, access), access.Visibility, nil
+}
+
+// imageRole derives userID's role on an image from their access to it
+func imageRole(userID string, access *db.ImageAccess) Role {
+	switch {
+	case userID != "" && access.OwnerID == userID:
+		return RoleOwner
+	case access.InSharedAlbum:
+		return RoleViewer
+	}
+	return RoleNone
+}
+
+// AlbumRole returns userID's role on an album: RoleOwner for its owner, the
+// member role for users who accepted an invitation, RoleNone otherwise
+func AlbumRole(ctx context.Context, userID, albumID string) (Role, error) {
+	ownerID, memberRole, err := db.GetAlbumAccess(ctx, albumID, userID)
+	if err != nil {
+		return RoleNone, err
+	}
+	if ownerID == "" {
+		return RoleNone, ErrNotFound
+	}
+	if userID != "" && ownerID == userID {
+		return RoleOwner, nil
+	}
+	return MemberRole(memberRole), nil
+}
+
+// Image returns nil if userID may perform action on the image. Anyone may
+// view public and unlisted images. Users who cannot view the image get
+// ErrNotFound, so private image IDs aren't confirmed to outsiders; others
+// lacking the permission get ErrForbidden.
+func Image(ctx context.Context, userID, imageID string, action Action) error {
+	access, err := db.GetImageAccess(ctx, imageID, userID)
+	if err != nil {
+		return err
+	}
+	if access == nil {
+		return ErrNotFound
+	}
+	return checkImage(userID, access, action)
+}
+
+// Images checks action on many images with a single query, like Image. It
+// returns each image's result: nil, ErrNotFound or ErrForbidden.
+func Images(ctx context.Context, userID string, imageIDs []string, action Action) (map[string]error, error) {
+	access, err := db.GetImagesAccess(ctx, imageIDs, userID)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]error, len(imageIDs))
+	for _, id := range imageIDs {
+		a, ok := access[id]
+		if !ok {
+			results[id] = ErrNotFound
+			continue
+		}
+		results[id] = checkImage(userID, &a, action)
+	}
+	return results, nil
+}
+
+// checkImage decides whether userID may perform action on an image they
+// have the given access to; see Image
+func checkImage(userID string, access *db.ImageAccess, action Action) error {
+	role := imageRole(userID, access)
+	if access.Trashed && (action != ImageRestore || !role.Can(action)) {
+		return ErrNotFound
+	}
+	if access.Visibility == db.VisibilityPrivate && !role.Can(ImageView) {
+		return ErrNotFound
+	}
+	if action != ImageView && !role.Can(action) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Album returns the user's role if they may perform action on the album.
+// Users who cannot even view the album get ErrNotFound, so album IDs aren't
+// confirmed to outsiders; members lacking the permission get ErrForbidden.
+func Album(ctx context.Context, userID, albumID string, action Action) (Role, error) {
+	role, err := AlbumRole(ctx, userID, albumID)
+	if err != nil {
+		return RoleNone, err
+	}
+	if !role.Can(AlbumView) {
+		return RoleNone, ErrNotFound
+	}
+	if !role.Can(action) {
+		return role, ErrForbidden
+	}
+	return role, nil
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// Album membership states
+const (
+	MemberInvited = "invited"
+	MemberActive  = "active"
+)
+
+// AlbumMember represents a user invited to or sharing an album
+type AlbumMember struct {
+	AlbumID     string
+	UserID      string
+	Email       string
+	DisplayName string
+	Role        string
+	Status      string
+	InvitedBy   string
+	CreatedAt   string
+}
+
+// AlbumInvitation is a pending invitation as seen by the invitee
+type AlbumInvitation struct {
+	AlbumID       string
+	AlbumTitle    string
+	Role          string
+	InvitedByID   string
+	InvitedByName string
+	CreatedAt     string
+}
+
+// GetAlbumAccess returns an album's owner and userID's active member role
+// ("" if they are not an active member). ownerID is "" if the album does not
+// exist.
+func GetAlbumAccess(ctx context.Context, albumID, userID string) (ownerID, memberRole string, err error) {
+	err = DB.QueryRowContext(ctx,
+		`SELECT a.owner_id, COALESCE(m.role, '')
+		 FROM albums a
+		 LEFT JOIN album_members m
+		        ON m.album_id = a.id AND m.user_id = NULLIF($2, '')::uuid AND m.status = 'active'
+		 WHERE a.id = $1`,
+		albumID, userID,
+	).Scan(&ownerID, &memberRole)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return ownerID, memberRole, err
+}
+
+// InviteAlbumMember invites a user to an album with the given role. If the
+// user is already invited or a member, only their role is changed.
+func InviteAlbumMember(ctx context.Context, albumID, userID, role, invitedBy string) error {
+	_, err := DB.ExecContext(ctx,
+		`INSERT INTO album_members (album_id, user_id, role, invited_by)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (album_id, user_id) DO UPDATE SET role = EXCLUDED.role`,
+		albumID, userID, role, invitedBy,
+	)
+	return err
+}
+
+// GetAlbumMember retrieves one member or invitee of an album
+func GetAlbumMember(ctx context.Context, albumID, userID string) (*AlbumMember, error) {
+	var m AlbumMember
+	err := DB.QueryRowContext(ctx,
+		`SELECT m.album_id, m.user_id, u.email, COALESCE(u.display_name, ''), m.role, m.status,
+		        COALESCE(m.invited_by::text, ''), m.created_at::text
+		 FROM album_members m
+		 JOIN users u ON m.user_id = u.id
+		 WHERE m.album_id = $1 AND m.user_id = $2`,
+		albumID, userID,
+	).Scan(&m.AlbumID, &m.UserID, &m.Email, &m.DisplayName, &m.Role, &m.Status, &m.InvitedBy, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ListAlbumMembers returns an album's members and pending invitees
+func ListAlbumMembers(ctx context.Context, albumID string) ([]AlbumMember, error) {
+	rows, err := DB.QueryContext(ctx,
+		`SELECT m.album_id, m.user_id, u.email, COALESCE(u.display_name, ''), m.role, m.status,
+		        COALESCE(m.invited_by::text, ''), m.created_at::text
+		 FROM album_members m
+		 JOIN users u ON m.user_id = u.id
+		 WHERE m.album_id = $1
+		 ORDER BY m.created_at, m.user_id`,
+		albumID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []AlbumMember
+	for rows.Next() {
+		var m AlbumMember
+		if err := rows.Scan(&m.AlbumID, &m.UserID, &m.Email, &m.DisplayName, &m.Role, &m.Status, &m.InvitedBy, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// ListAlbumInvitations returns a user's pending album invitations
+func ListAlbumInvitations(ctx context.Context, userID string) ([]AlbumInvitation, error) {
+	rows, err := DB.QueryContext(ctx,
+		`SELECT a.id, a.title, m.role, COALESCE(m.invited_by::text, ''),
+		        COALESCE(inviter.display_name, inviter.email, ''), m.created_at::text
+		 FROM album_members m
+		 JOIN albums a ON m.album_id = a.id
+		 LEFT JOIN users inviter ON m.invited_by = inviter.id
+		 WHERE m.user_id = $1 AND m.status = 'invited'
+		 ORDER BY m.created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []AlbumInvitation
+	for rows.Next() {
+		var inv AlbumInvitation
+		if err := rows.Scan(&inv.AlbumID, &inv.AlbumTitle, &inv.Role, &inv.InvitedByID, &inv.InvitedByName, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// AcceptAlbumInvitation activates a pending invitation. It returns false if
+// the user has no pending invitation to the album.
+func AcceptAlbumInvitation(ctx context.Context, albumID, userID string) (bool, error) {
+	res, err := DB.ExecContext(ctx,
+		`UPDATE album_members SET status = 'active', accepted_at = NOW()
+		 WHERE album_id = $1 AND user_id = $2 AND status = 'invited'`,
+		albumID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RemoveAlbumMember removes a member or withdraws an invitation. Images the
+// member added stay in the album. It returns false if there was nothing to
+// remove.
+func RemoveAlbumMember(ctx context.Context, albumID, userID string) (bool, error) {
+	res, err := DB.ExecContext(ctx,
+		"DELETE FROM album_members WHERE album_id = $1 AND user_id = $2",
+		albumID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ImageAccess is what authorizing a user's access to an image depends on
+type ImageAccess struct {
+	OwnerID    string
+	Visibility string
+	// InSharedAlbum reports whether the user can see the image through an
+	// album: one they own or are an active member of that contains it
+	InSharedAlbum bool
+	Trashed       bool
+}
+
+// GetImageAccess returns userID's access to an image, or nil if the image
+// does not exist
+func GetImageAccess(ctx context.Context, imageID, userID string) (*ImageAccess, error) {
+	access, err := GetImagesAccess(ctx, []string{imageID}, userID)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := access[imageID]
+	if !ok {
+		return nil, nil
+	}
+	return &a, nil
+}
+
+// inSharedAlbum returns an SQL condition that holds when image i is in an
+// album owned by, or shared with, the user whose ID is the SQL expression
+// userID. It is what lets a private image be seen by someone other than
+// its owner, so every query deciding that should use it.
+func inSharedAlbum(userID string) string {
+	return `EXISTS (
+		    SELECT 1 FROM album_images ai
+		    JOIN albums a ON ai.album_id = a.id
+		    LEFT JOIN album_members m
+		           ON m.album_id = a.id AND m.user_id = ` + userID + ` AND m.status = 'active'
+		    WHERE ai.image_id = i.id
+		      AND (a.owner_id = ` + userID + ` OR m.user_id IS NOT NULL)
+		)`
+}
+
+// GetImagesAccess returns userID's access to each of the images that exist,
+// keyed by image ID
+func GetImagesAccess(ctx context.Context, imageIDs []string, userID string) (map[string]ImageAccess, error) {
+	rows, err := DB.QueryContext(ctx,
+		`SELECT i.id, i.owner_id, i.visibility,
+		        NULLIF($2, '') IS NOT NULL AND `+inSharedAlbum(`NULLIF($2, '')::uuid`)+`,
+		        i.deleted_at IS NOT NULL
+		 FROM images i
+		 WHERE i.id = ANY($1::uuid[])`,
+		pq.Array(imageIDs), userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	access := make(map[string]ImageAccess, len(imageIDs))
+	for rows.Next() {
+		var id string
+		var a ImageAccess
+		if err := rows.Scan(&id, &a.OwnerID, &a.Visibility, &a.InSharedAlbum, &a.Trashed); err != nil {
+			return nil, err
+		}
+		access[id] = a
+	}
+	return access, rows.Err()
+}
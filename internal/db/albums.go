@@ -0,0 +1,418 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// Album member roles
+const (
+	AlbumRoleViewer      = "viewer"
+	AlbumRoleContributor = "contributor"
+	AlbumRoleEditor      = "editor"
+)
+
+// Album represents an album in the database
+type Album struct {
+	ID               string
+	OwnerID          string
+	OwnerDisplayName string
+	Title            string
+	Description      string
+	CoverImageID     string // explicit cover; "" falls back to the first image
+	CoverThumbnail   []byte
+	ImageCount       int
+	CreatedAt        string
+	UpdatedAt        string
+	MemberRole       string // the listing user's member role; "" for the owner
+}
+
+// albumColumns selects an Album; the cover thumbnail is the chosen cover's,
+// or the first image's when no cover is set. Trashed images are left out.
+const albumColumns = `
+	a.id, a.owner_id, COALESCE(u.display_name, u.email) as owner_name,
+	a.title, COALESCE(a.description, ''), COALESCE(a.cover_image_id::text, ''),
+	(SELECT i.thumbnail FROM images i
+	 WHERE i.deleted_at IS NULL AND i.id = COALESCE(a.cover_image_id, (
+	     SELECT ai.image_id FROM album_images ai JOIN images fi ON ai.image_id = fi.id
+	     WHERE ai.album_id = a.id AND fi.deleted_at IS NULL
+	     ORDER BY ai.position, ai.image_id LIMIT 1
+	 ))),
+	(SELECT COUNT(*) FROM album_images ai JOIN images ci ON ai.image_id = ci.id
+	 WHERE ai.album_id = a.id AND ci.deleted_at IS NULL),
+	a.created_at::text, a.updated_at::text`
+
+func scanAlbum(row interface{ Scan(...any) error }, a *Album) error {
+	return row.Scan(&a.ID, &a.OwnerID, &a.OwnerDisplayName, &a.Title, &a.Description,
+		&a.CoverImageID, &a.CoverThumbnail, &a.ImageCount, &a.CreatedAt, &a.UpdatedAt)
+}
+
+// CreateAlbum creates an album containing imageIDs in order and returns its ID
+func CreateAlbum(ctx context.Context, ownerID, title, description string, imageIDs []string) (string, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO albums (owner_id, title, description) VALUES ($1, $2, NULLIF($3, ''))
+		 RETURNING id`,
+		ownerID, title, description,
+	).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	if len(imageIDs) > 0 {
+		if _, err := addAlbumImages(ctx, tx, id, ownerID, imageIDs); err != nil {
+			return "", err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// GetAlbum retrieves an album by ID
+func GetAlbum(ctx context.Context, albumID string) (*Album, error) {
+	var a Album
+	err := scanAlbum(DB.QueryRowContext(ctx,
+		`SELECT `+albumColumns+`
+		 FROM albums a
+		 JOIN users u ON a.owner_id = u.id
+		 WHERE a.id = $1`,
+		albumID,
+	), &a)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// ListAlbumsForUser returns the albums a user owns or is an active member
+// of, most recently updated first
+func ListAlbumsForUser(ctx context.Context, userID string, limit, offset int) ([]Album, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM albums a
+		 LEFT JOIN album_members m ON m.album_id = a.id AND m.user_id = $1 AND m.status = 'active'
+		 WHERE a.owner_id = $1 OR m.user_id IS NOT NULL`,
+		userID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+albumColumns+`, COALESCE(m.role, '')
+		 FROM albums a
+		 JOIN users u ON a.owner_id = u.id
+		 LEFT JOIN album_members m ON m.album_id = a.id AND m.user_id = $2 AND m.status = 'active'
+		 WHERE a.owner_id = $2 OR m.user_id IS NOT NULL
+		 ORDER BY a.updated_at DESC, a.id
+		 LIMIT $1 OFFSET $3`,
+		limit, userID, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var albums []Album
+	for rows.Next() {
+		var a Album
+		if err := rows.Scan(&a.ID, &a.OwnerID, &a.OwnerDisplayName, &a.Title, &a.Description,
+			&a.CoverImageID, &a.CoverThumbnail, &a.ImageCount, &a.CreatedAt, &a.UpdatedAt, &a.MemberRole); err != nil {
+			return nil, 0, err
+		}
+		albums = append(albums, a)
+	}
+	return albums, total, rows.Err()
+}
+
+// ListAlbumImages returns an album's images in album order
+func ListAlbumImages(ctx context.Context, albumID string, limit, offset int) ([]ImageInfo, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM album_images ai
+		 JOIN images i ON ai.image_id = i.id
+		 WHERE ai.album_id = $1 AND i.deleted_at IS NULL`,
+		albumID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+imageInfoColumns+`
+		 FROM album_images ai
+		 JOIN images i ON ai.image_id = i.id
+		 JOIN users u ON i.owner_id = u.id
+		 WHERE ai.album_id = $2 AND i.deleted_at IS NULL
+		 ORDER BY ai.position, ai.image_id
+		 LIMIT $1 OFFSET $3`,
+		limit, albumID, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var images []ImageInfo
+	for rows.Next() {
+		var img ImageInfo
+		if err := rows.Scan(img.fields()...); err != nil {
+			return nil, 0, err
+		}
+		images = append(images, img)
+	}
+	return images, total, rows.Err()
+}
+
+// UpdateAlbum updates album details. coverImageID "" clears the cover; the
+// caller must check that the cover is in the album.
+func UpdateAlbum(ctx context.Context, albumID, title, description, coverImageID string) error {
+	_, err := DB.ExecContext(ctx,
+		`UPDATE albums SET title = $1, description = NULLIF($2, ''),
+		        cover_image_id = NULLIF($3, '')::uuid, updated_at = NOW()
+		 WHERE id = $4`,
+		title, description, coverImageID, albumID,
+	)
+	return err
+}
+
+// DeleteAlbum removes an album. Its images are not deleted.
+func DeleteAlbum(ctx context.Context, albumID string) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM albums WHERE id = $1", albumID)
+	return err
+}
+
+// GetImageOwners returns the owner of each of the given images. Images that
+// don't exist are absent from the map.
+func GetImageOwners(ctx context.Context, imageIDs []string) (map[string]string, error) {
+	rows, err := DB.QueryContext(ctx,
+		"SELECT id, owner_id FROM images WHERE id = ANY($1::uuid[]) AND deleted_at IS NULL",
+		pq.Array(imageIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]string, len(imageIDs))
+	for rows.Next() {
+		var id, ownerID string
+		if err := rows.Scan(&id, &ownerID); err != nil {
+			return nil, err
+		}
+		owners[id] = ownerID
+	}
+	return owners, rows.Err()
+}
+
+// AlbumHasImage reports whether an image is in an album
+func AlbumHasImage(ctx context.Context, albumID, imageID string) (bool, error) {
+	var exists bool
+	err := DB.QueryRowContext(ctx,
+		`SELECT EXISTS (
+		     SELECT 1 FROM album_images ai JOIN images i ON ai.image_id = i.id
+		     WHERE ai.album_id = $1 AND ai.image_id = $2 AND i.deleted_at IS NULL
+		 )`,
+		albumID, imageID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// lockAlbum takes the album's row lock so concurrent edits to its image
+// order are serialized
+func lockAlbum(ctx context.Context, tx *sql.Tx, albumID string) error {
+	_, err := tx.ExecContext(ctx, "SELECT 1 FROM albums WHERE id = $1 FOR UPDATE", albumID)
+	return err
+}
+
+// addAlbumImages appends images to the end of an album in the given order,
+// skipping any already in it. addedBy records who added them.
+func addAlbumImages(ctx context.Context, tx *sql.Tx, albumID, addedBy string, imageIDs []string) (int, error) {
+	if err := lockAlbum(ctx, tx, albumID); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO album_images (album_id, image_id, position, added_by)
+		 SELECT $1, t.id, m.last + t.ord, $3
+		 FROM unnest($2::uuid[]) WITH ORDINALITY AS t(id, ord),
+		      (SELECT COALESCE(MAX(position), 0) AS last FROM album_images WHERE album_id = $1) m
+		 ON CONFLICT (album_id, image_id) DO NOTHING`,
+		albumID, pq.Array(imageIDs), addedBy,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE albums SET updated_at = NOW() WHERE id = $1", albumID); err != nil {
+			return 0, err
+		}
+	}
+	return int(n), nil
+}
+
+// AddAlbumImages appends images to an album on behalf of addedBy (the caller
+// must check that they may add them) and returns how many were not already
+// present
+func AddAlbumImages(ctx context.Context, albumID, addedBy string, imageIDs []string) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	n, err := addAlbumImages(ctx, tx, albumID, addedBy, imageIDs)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// RemoveAlbumImages removes images from an album and returns how many were
+// removed. If addedBy is set, only images that user added are removed.
+// Removing the cover image clears the cover.
+func RemoveAlbumImages(ctx context.Context, albumID string, imageIDs []string, addedBy string) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`DELETE FROM album_images
+		 WHERE album_id = $1 AND image_id = ANY($2::uuid[])
+		   AND (NULLIF($3, '') IS NULL OR added_by = NULLIF($3, '')::uuid)
+		 RETURNING image_id`,
+		albumID, pq.Array(imageIDs), addedBy,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var removed []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		removed = append(removed, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE albums SET updated_at = NOW(),
+		        cover_image_id = CASE WHEN cover_image_id = ANY($2::uuid[]) THEN NULL ELSE cover_image_id END
+		 WHERE id = $1`,
+		albumID, pq.Array(removed),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return len(removed), tx.Commit()
+}
+
+// ReorderAlbumImages moves images, in the given order, to just after
+// afterImageID ("" moves them to the start). It returns false without
+// changing anything if any of the images is not in the album.
+func ReorderAlbumImages(ctx context.Context, albumID string, imageIDs []string, afterImageID string) (bool, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := lockAlbum(ctx, tx, albumID); err != nil {
+		return false, err
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT image_id FROM album_images WHERE album_id = $1 ORDER BY position, image_id",
+		albumID,
+	)
+	if err != nil {
+		return false, err
+	}
+	var current []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return false, err
+		}
+		current = append(current, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	inAlbum := make(map[string]bool, len(current))
+	for _, id := range current {
+		inAlbum[id] = true
+	}
+	moved := make(map[string]bool, len(imageIDs))
+	for _, id := range imageIDs {
+		if !inAlbum[id] || moved[id] {
+			return false, nil
+		}
+		moved[id] = true
+	}
+	if afterImageID != "" && (!inAlbum[afterImageID] || moved[afterImageID]) {
+		return false, nil
+	}
+
+	// Rebuild the full order and renumber every position
+	order := make([]string, 0, len(current))
+	if afterImageID == "" {
+		order = append(order, imageIDs...)
+	}
+	for _, id := range current {
+		if moved[id] {
+			continue
+		}
+		order = append(order, id)
+		if id == afterImageID {
+			order = append(order, imageIDs...)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE album_images ai SET position = t.ord
+		 FROM unnest($2::uuid[]) WITH ORDINALITY AS t(id, ord)
+		 WHERE ai.album_id = $1 AND ai.image_id = t.id`,
+		albumID, pq.Array(order),
+	)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE albums SET updated_at = NOW() WHERE id = $1", albumID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// ImagePatch is a change applied to every image in a batch. Nil fields and
+// empty tag lists leave images unchanged.
+type ImagePatch struct {
+	// MetadataPrivacy "" inherits the owner's default
+	MetadataPrivacy *string
+	Visibility      *string
+	AddTags         []string
+	RemoveTags      []string
+}
+
+// lockImages locks the images among imageIDs (which must be well-formed;
+// see ValidUUID) that still exist and aren't trashed for the rest of the
+// transaction, returning their IDs
+func lockImages(ctx context.Context, tx *sql.Tx, imageIDs []string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id FROM images WHERE id = ANY($1::uuid[]) AND deleted_at IS NULL ORDER BY id FOR UPDATE",
+		pq.Array(imageIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// BatchUpdateImages applies patch to images on behalf of editorID (owner
+// must be verified by caller) in one transaction, recording a revision for
+// each image that changed. Images that would end up with more than
+// maxTags tags are left unchanged and returned in overTagLimit; updated
+// lists the images that were changed. Images deleted or trashed meanwhile
+// are in neither.
+func BatchUpdateImages(ctx context.Context, imageIDs []string, editorID string, patch ImagePatch, maxTags int) (updated, overTagLimit []string, err error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	ids, err := lockImages(ctx, tx, imageIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(patch.AddTags) > 0 {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT ids.id FROM unnest($1::uuid[]) ids(id)
+			 WHERE (SELECT COUNT(*) FROM (
+			            SELECT t.name FROM image_tags it JOIN tags t ON it.tag_id = t.id
+			            WHERE it.image_id = ids.id AND t.name <> ALL($3::text[])
+			            UNION
+			            SELECT unnest($2::text[])
+			        ) n) > $4`,
+			pq.Array(ids), pq.Array(patch.AddTags), pq.Array(patch.RemoveTags), maxTags,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		over := make(map[string]bool)
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			over[id] = true
+			overTagLimit = append(overTagLimit, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+		for _, id := range ids {
+			if !over[id] {
+				updated = append(updated, id)
+			}
+		}
+	} else {
+		updated = ids
+	}
+	if len(updated) == 0 {
+		return nil, overTagLimit, tx.Commit()
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE images SET
+		        metadata_privacy = CASE WHEN $2 THEN NULLIF($3, '') ELSE metadata_privacy END,
+		        visibility = COALESCE($4, visibility),
+		        updated_at = NOW()
+		 WHERE id = ANY($1::uuid[])`,
+		pq.Array(updated), patch.MetadataPrivacy != nil, derefString(patch.MetadataPrivacy), patch.Visibility,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(patch.RemoveTags) > 0 {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM image_tags it USING tags t
+			 WHERE it.tag_id = t.id AND it.image_id = ANY($1::uuid[]) AND t.name = ANY($2::text[])`,
+			pq.Array(updated), pq.Array(patch.RemoveTags),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(patch.AddTags) > 0 {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO tags (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING",
+			pq.Array(patch.AddTags),
+		); err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO image_tags (image_id, tag_id)
+			 SELECT ids.id, t.id FROM unnest($1::uuid[]) ids(id) CROSS JOIN tags t
+			 WHERE t.name = ANY($2::text[])
+			 ON CONFLICT DO NOTHING`,
+			pq.Array(updated), pq.Array(patch.AddTags),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := recordRevisions(ctx, tx, updated, editorID); err != nil {
+		return nil, nil, err
+	}
+	return updated, overTagLimit, tx.Commit()
+}
+
+// derefString returns *s, or "" for nil
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
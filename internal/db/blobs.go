@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+
+	"github.com/lib/pq"
+)
+
+// ContentHash returns the hex SHA-256 of data, the key blobs are stored under
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// acquireBlob stores data (once per distinct content) and takes a reference
+// to it, returning its hash. It must run inside the caller's transaction.
+func acquireBlob(ctx context.Context, q queryer, data []byte) (string, error) {
+	hash := ContentHash(data)
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO blobs (sha256, data, size, ref_count) VALUES ($1, $2, $3, 1)
+		 ON CONFLICT (sha256) DO UPDATE SET ref_count = blobs.ref_count + 1`,
+		hash, data, len(data),
+	)
+	return hash, err
+}
+
+// retainBlob takes another reference to a stored blob. It must run inside
+// the caller's transaction.
+func retainBlob(ctx context.Context, q queryer, hash string) error {
+	_, err := q.ExecContext(ctx, "UPDATE blobs SET ref_count = ref_count + 1 WHERE sha256 = $1", hash)
+	return err
+}
+
+// releaseBlob drops a reference to a blob, deleting it once the last
+// reference is gone. It must run inside the caller's transaction.
+func releaseBlob(ctx context.Context, q queryer, hash string) error {
+	var refs int
+	err := q.QueryRowContext(ctx,
+		"UPDATE blobs SET ref_count = ref_count - 1 WHERE sha256 = $1 RETURNING ref_count",
+		hash,
+	).Scan(&refs)
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		return nil
+	}
+	_, err = q.ExecContext(ctx, "DELETE FROM blobs WHERE sha256 = $1 AND ref_count <= 0", hash)
+	return err
+}
+
+// releaseBlobs drops one reference per entry in hashes (which may repeat),
+// deleting blobs whose last reference is gone. It must run inside the
+// caller's transaction.
+func releaseBlobs(ctx context.Context, q queryer, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	_, err := q.ExecContext(ctx,
+		`UPDATE blobs b SET ref_count = b.ref_count - r.n
+		 FROM (SELECT h, COUNT(*) AS n FROM unnest($1::text[]) h GROUP BY h) r
+		 WHERE b.sha256 = r.h`,
+		pq.Array(hashes),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "DELETE FROM blobs WHERE sha256 = ANY($1::text[]) AND ref_count <= 0", pq.Array(hashes))
+	return err
+}
+
+// FindImageByUploadHash returns the ID of the owner's image whose uploaded
+// bytes had the given hash, or "" if there is none
+func FindImageByUploadHash(ctx context.Context, ownerID, hash string) (string, error) {
+	var imageID string
+	err := DB.QueryRowContext(ctx,
+		`SELECT id FROM images WHERE owner_id = $1 AND upload_sha256 = $2 AND deleted_at IS NULL
+		 ORDER BY created_at LIMIT 1`,
+		ownerID, hash,
+	).Scan(&imageID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return imageID, err
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Errors returned by CreateComment
+var (
+	ErrCommentsDisabled = errors.New("comments are disabled")
+	ErrCommentThrottled = errors.New("too many comments")
+	ErrDuplicateComment = errors.New("duplicate comment")
+)
+
+// Comment is a comment on an image or a reply to one
+type Comment struct {
+	ID                string
+	ImageID           string
+	ParentID          string // "" for top-level comments
+	AuthorID          string
+	AuthorDisplayName string
+	Body              string // "" once deleted
+	CreatedAt         string
+	EditedAt          string // "" if never edited
+	Deleted           bool   // kept only because it still has replies
+	ReplyCount        int
+}
+
+// CommentThrottle limits how many comments one user may post
+type CommentThrottle struct {
+	PerMinute int
+	PerHour   int
+}
+
+const commentColumns = `
+	c.id, c.image_id, COALESCE(c.parent_id::text, ''), c.author_id, COALESCE(u.display_name, u.email),
+	c.body, c.created_at::text, COALESCE(c.edited_at::text, ''), c.deleted_at IS NOT NULL,
+	(SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id)`
+
+// scanComment scans a row selected with commentColumns from comments c
+// joined with users u
+func scanComment(row interface{ Scan(...any) error }, c *Comment) error {
+	return row.Scan(&c.ID, &c.ImageID, &c.ParentID, &c.AuthorID, &c.AuthorDisplayName,
+		&c.Body, &c.CreatedAt, &c.EditedAt, &c.Deleted, &c.ReplyCount)
+}
+
+// CreateComment adds a comment to an image, as a reply if parentID is set.
+// Replies to replies are attached to the top-level comment, keeping one
+// level of nesting. It returns nil if the image or parent comment doesn't
+// exist, ErrCommentsDisabled if the owner has turned comments off, and
+// ErrCommentThrottled or ErrDuplicateComment if the author is posting too
+// fast or repeating a comment from the last hour. The author's row is
+// locked so their concurrent posts are throttled one at a time.
+func CreateComment(ctx context.Context, imageID, parentID, authorID, body string, throttle CommentThrottle) (*Comment, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT 1 FROM users WHERE id = $1 FOR UPDATE", authorID); err != nil {
+		return nil, err
+	}
+
+	var disabled bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT comments_disabled FROM images WHERE id = $1 AND deleted_at IS NULL",
+		imageID,
+	).Scan(&disabled)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if disabled {
+		return nil, ErrCommentsDisabled
+	}
+
+	if parentID != "" {
+		err = tx.QueryRowContext(ctx,
+			`SELECT COALESCE(parent_id, id) FROM comments
+			 WHERE id = $1 AND image_id = $2 AND deleted_at IS NULL`,
+			parentID, imageID,
+		).Scan(&parentID)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lastMinute, lastHour int
+	var duplicate bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FILTER (WHERE created_at > NOW() - INTERVAL '1 minute'), COUNT(*),
+		        COALESCE(bool_or(image_id = $2 AND body = $3), false)
+		 FROM comments
+		 WHERE author_id = $1 AND created_at > NOW() - INTERVAL '1 hour'`,
+		authorID, imageID, body,
+	).Scan(&lastMinute, &lastHour, &duplicate)
+	if err != nil {
+		return nil, err
+	}
+	if duplicate {
+		return nil, ErrDuplicateComment
+	}
+	if lastMinute >= throttle.PerMinute || lastHour >= throttle.PerHour {
+		return nil, ErrCommentThrottled
+	}
+
+	var id string
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO comments (image_id, parent_id, author_id, body)
+		 VALUES ($1, NULLIF($2, '')::uuid, $3, $4) RETURNING id`,
+		imageID, parentID, authorID, body,
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetComment(ctx, id)
+}
+
+// GetComment retrieves a comment by ID, or nil if it doesn't exist
+func GetComment(ctx context.Context, commentID string) (*Comment, error) {
+	var c Comment
+	err := scanComment(DB.QueryRowContext(ctx,
+		`SELECT `+commentColumns+`
+		 FROM comments c JOIN users u ON c.author_id = u.id
+		 WHERE c.id = $1`,
+		commentID,
+	), &c)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ListComments returns the top-level comments on an image, or the replies
+// to parentID if set, oldest first, and their total
+func ListComments(ctx context.Context, imageID, parentID string, limit, offset int) ([]Comment, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	const where = `WHERE c.image_id = $1
+		   AND (($2 = '' AND c.parent_id IS NULL) OR c.parent_id = NULLIF($2, '')::uuid)`
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM comments c `+where,
+		imageID, parentID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+commentColumns+`
+		 FROM comments c JOIN users u ON c.author_id = u.id
+		 `+where+`
+		 ORDER BY c.created_at, c.id
+		 LIMIT $3 OFFSET $4`,
+		imageID, parentID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var c Comment
+		if err := scanComment(rows, &c); err != nil {
+			return nil, 0, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, total, rows.Err()
+}
+
+// EditComment replaces the body of a comment by authorID, reporting whether
+// there was such a comment to edit
+func EditComment(ctx context.Context, commentID, authorID, body string) (bool, error) {
+	res, err := DB.ExecContext(ctx,
+		`UPDATE comments SET body = $3, edited_at = NOW()
+		 WHERE id = $1 AND author_id = $2 AND deleted_at IS NULL`,
+		commentID, authorID, body,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteComment deletes a comment (permission must be verified by caller),
+// reporting whether it existed. A comment with replies is emptied instead,
+// and an emptied comment goes once its last reply does.
+func DeleteComment(ctx context.Context, commentID string) (bool, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var parentID string
+	var hasReplies bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(parent_id::text, ''), EXISTS (SELECT 1 FROM comments r WHERE r.parent_id = c.id)
+		 FROM comments c WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`,
+		commentID,
+	).Scan(&parentID, &hasReplies)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if hasReplies {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE comments SET body = '', deleted_at = NOW() WHERE id = $1",
+			commentID,
+		)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM comments WHERE id = $1", commentID)
+	}
+	if err != nil {
+		return false, err
+	}
+	if parentID != "" {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM comments p WHERE id = $1 AND deleted_at IS NOT NULL
+			 AND NOT EXISTS (SELECT 1 FROM comments r WHERE r.parent_id = p.id)`,
+			parentID,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// CommentsDisabled reports whether the owner has turned off new comments
+// on an image
+func CommentsDisabled(ctx context.Context, imageID string) (bool, error) {
+	var disabled bool
+	err := DB.QueryRowContext(ctx, "SELECT comments_disabled FROM images WHERE id = $1", imageID).Scan(&disabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return disabled, err
+}
+
+// SetCommentsDisabled turns new comments on an image off or on (owner must
+// be verified by caller). Existing comments stay visible.
+func SetCommentsDisabled(ctx context.Context, imageID string, disabled bool) error {
+	_, err := DB.ExecContext(ctx,
+		"UPDATE images SET comments_disabled = $2 WHERE id = $1",
+		imageID, disabled,
+	)
+	return err
+}
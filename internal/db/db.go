@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 
 	_ "github.com/lib/pq"
 )
@@ -37,3 +38,23 @@ func Close() error {
 	}
 	return nil
 }
+
+// ValidUUID reports whether s is a UUID in its canonical text form. IDs
+// from requests should be checked with it before reaching a ::uuid cast,
+// which would otherwise fail the whole query.
+func ValidUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if r != '-' {
+				return false
+			}
+		case !strings.ContainsRune("0123456789abcdefABCDEF", r):
+			return false
+		}
+	}
+	return true
+}
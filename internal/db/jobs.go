@@ -0,0 +1,309 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Job kinds
+const (
+	// JobProcessImage generates derivatives (thumbnail, dimensions) for an image
+	JobProcessImage = "process_image"
+)
+
+// Job states
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobDead    = "dead"
+)
+
+// Image processing states
+const (
+	ProcessingPending    = "pending"
+	ProcessingInProgress = "processing"
+	ProcessingReady      = "ready"
+	ProcessingFailed     = "failed"
+)
+
+// defaultJobAttempts is how many times a job runs before it is dead-lettered
+const defaultJobAttempts = 5
+
+// Job represents a claimed job from the queue
+type Job struct {
+	ID          string
+	Kind        string
+	ImageID     string
+	Payload     []byte // JSON
+	Attempts    int
+	MaxAttempts int
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// enqueueJob inserts a pending job using q, so it can join a caller's transaction
+func enqueueJob(ctx context.Context, q queryer, kind, imageID string, payload []byte) error {
+	if payload == nil {
+		payload = []byte("{}")
+	}
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO jobs (kind, image_id, payload, max_attempts) VALUES ($1, NULLIF($2, '')::uuid, $3, $4)`,
+		kind, imageID, payload, defaultJobAttempts,
+	)
+	return err
+}
+
+// EnqueueJob adds a job to the queue to run as soon as a worker is free
+func EnqueueJob(ctx context.Context, kind, imageID string, payload []byte) error {
+	return enqueueJob(ctx, DB, kind, imageID, payload)
+}
+
+// ClaimJob locks the next runnable job and marks it running. Jobs left
+// running for longer than lease (e.g. by a crashed worker) are reclaimed.
+// Returns nil if no job is available.
+func ClaimJob(ctx context.Context, lease time.Duration) (*Job, error) {
+	var j Job
+	err := DB.QueryRowContext(ctx,
+		`UPDATE jobs SET status = 'running', attempts = attempts + 1, locked_at = NOW(), updated_at = NOW()
+		 WHERE id = (
+		     SELECT id FROM jobs
+		     WHERE (status = 'pending' AND run_at <= NOW())
+		        OR (status = 'running' AND locked_at < NOW() - make_interval(secs => $1))
+		     ORDER BY run_at
+		     LIMIT 1
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, kind, COALESCE(image_id::text, ''), payload, attempts, max_attempts`,
+		lease.Seconds(),
+	).Scan(&j.ID, &j.Kind, &j.ImageID, &j.Payload, &j.Attempts, &j.MaxAttempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// CompleteJob marks a job as done
+func CompleteJob(ctx context.Context, jobID string) error {
+	_, err := DB.ExecContext(ctx,
+		"UPDATE jobs SET status = 'done', last_error = NULL, locked_at = NULL, updated_at = NOW() WHERE id = $1",
+		jobID,
+	)
+	return err
+}
+
+// RetryJob releases a failed job to run again after delay
+func RetryJob(ctx context.Context, jobID, lastError string, delay time.Duration) error {
+	_, err := DB.ExecContext(ctx,
+		`UPDATE jobs SET status = 'pending', last_error = $1, locked_at = NULL,
+		        run_at = NOW() + make_interval(secs => $2), updated_at = NOW()
+		 WHERE id = $3`,
+		lastError, delay.Seconds(), jobID,
+	)
+	return err
+}
+
+// KillJob moves a job to the dead-letter state; it will not run again.
+// If the job belongs to an image, the image is marked as failed.
+func KillJob(ctx context.Context, jobID, lastError string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var imageID sql.NullString
+	err = tx.QueryRowContext(ctx,
+		`UPDATE jobs SET status = 'dead', last_error = $1, locked_at = NULL, updated_at = NOW()
+		 WHERE id = $2 RETURNING image_id`,
+		lastError, jobID,
+	).Scan(&imageID)
+	if err != nil {
+		return err
+	}
+	if imageID.Valid {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE images SET processing_status = 'failed', processing_error = $1 WHERE id = $2",
+			lastError, imageID.String,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetImageProcessing marks an image's derivatives as being (re)generated
+func SetImageProcessing(ctx context.Context, imageID string) error {
+	_, err := DB.ExecContext(ctx,
+		"UPDATE images SET processing_status = 'processing' WHERE id = $1",
+		imageID,
+	)
+	return err
+}
+
+// SetImageFailed marks an image's processing as failed outside the job queue
+func SetImageFailed(ctx context.Context, imageID, processingError string) error {
+	_, err := DB.ExecContext(ctx,
+		"UPDATE images SET processing_status = 'failed', processing_error = $1 WHERE id = $2",
+		processingError, imageID,
+	)
+	return err
+}
+
+// Derivatives are the results of processing an image
+type Derivatives struct {
+	// Data replaces the stored original when non-nil (e.g. after
+	// orientation normalization)
+	Data          []byte
+	Thumbnail     []byte
+	ThumbnailSpec string // the thumbnail settings used
+	// The rest describe the upright image with its edits applied
+	Width         int
+	Height        int
+	PHash         uint64 // perceptual hash
+	BlurHash      string
+	LQIP          string   // tiny JPEG data URI
+	Palette       []string // #rrggbb, most common first
+	DominantColor string   // named bucket of the most common palette color
+}
+
+// SaveImageDerivatives stores the results of processing contentVersion of
+// an image with the edits recipe and marks the image ready. Results for
+// content or edits that have since changed are discarded.
+func SaveImageDerivatives(ctx context.Context, imageID string, contentVersion int, edits []byte, d Derivatives) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldHash string
+	var current bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT blob_sha256, content_version = $2 AND edits IS NOT DISTINCT FROM $3::jsonb
+		 FROM images WHERE id = $1 FOR UPDATE`,
+		imageID, contentVersion, nullBytes(edits),
+	).Scan(&oldHash, &current)
+	if err == sql.ErrNoRows || (err == nil && !current) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.Data != nil {
+		newHash, err := acquireBlob(ctx, tx, d.Data)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE images SET blob_sha256 = $1 WHERE id = $2", newHash, imageID); err != nil {
+			return err
+		}
+		if err := releaseBlob(ctx, tx, oldHash); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE images SET thumbnail = $1, thumbnail_spec = $2, width = $3, height = $4, phash = $5,
+		        blurhash = $6, lqip = $7, palette = $8, dominant_color = NULLIF($9, ''),
+		        processing_status = 'ready', processing_error = NULL
+		 WHERE id = $10`,
+		d.Thumbnail, d.ThumbnailSpec, d.Width, d.Height, int64(d.PHash),
+		d.BlurHash, d.LQIP, pq.Array(d.Palette), d.DominantColor, imageID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RegenerateFilter selects images whose derivatives should be regenerated.
+// Zero values match everything.
+type RegenerateFilter struct {
+	OwnerID          string
+	CreatedAfter     *time.Time
+	CreatedBefore    *time.Time
+	ProcessingStatus string
+	// StaleSpec, if set, matches only images not processed with this thumbnail
+	// spec or missing other derivatives such as the perceptual hash or
+	// placeholders
+	StaleSpec string
+	// After is the resume cursor: only images with a greater ID match
+	After string
+}
+
+// regenerateWhere is the WHERE clause shared by the regeneration queries;
+// it uses parameters $1-$6 in the order returned by RegenerateFilter.args
+const regenerateWhere = `
+	WHERE (NULLIF($1, '') IS NULL OR owner_id = NULLIF($1, '')::uuid)
+	  AND ($2::timestamptz IS NULL OR created_at >= $2)
+	  AND ($3::timestamptz IS NULL OR created_at < $3)
+	  AND (NULLIF($4, '') IS NULL OR processing_status = $4)
+	  AND (NULLIF($5, '') IS NULL OR thumbnail_spec IS DISTINCT FROM $5 OR phash IS NULL OR blurhash IS NULL)
+	  AND (NULLIF($6, '') IS NULL OR id > NULLIF($6, '')::uuid)
+	  AND deleted_at IS NULL`
+
+func (f RegenerateFilter) args() []any {
+	return []any{f.OwnerID, f.CreatedAfter, f.CreatedBefore, f.ProcessingStatus, f.StaleSpec, f.After}
+}
+
+// CountImagesForRegeneration counts the images matching filter
+func CountImagesForRegeneration(ctx context.Context, filter RegenerateFilter) (int, error) {
+	var total int
+	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM images"+regenerateWhere, filter.args()...).Scan(&total)
+	return total, err
+}
+
+// ListImagesForRegeneration returns up to limit matching image IDs in ID order
+func ListImagesForRegeneration(ctx context.Context, filter RegenerateFilter, limit int) ([]string, error) {
+	rows, err := DB.QueryContext(ctx,
+		"SELECT id FROM images"+regenerateWhere+" ORDER BY id LIMIT $7",
+		append(filter.args(), limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// EnqueueImageProcessing queues process_image jobs for the given images,
+// skipping images that already have one pending or running. Returns the
+// number of jobs queued.
+func EnqueueImageProcessing(ctx context.Context, imageIDs []string) (int, error) {
+	res, err := DB.ExecContext(ctx,
+		`INSERT INTO jobs (kind, image_id, max_attempts)
+		 SELECT $1, i.id, $2 FROM images i
+		 WHERE i.id = ANY($3::uuid[])
+		   AND NOT EXISTS (
+		       SELECT 1 FROM jobs j
+		       WHERE j.image_id = i.id AND j.kind = $1 AND j.status IN ('pending', 'running')
+		   )`,
+		JobProcessImage, defaultJobAttempts, pq.Array(imageIDs),
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
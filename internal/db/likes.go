@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+)
+
+// LikeImage records that userID likes an image, returning its like count.
+// Liking an image twice has no further effect.
+func LikeImage(ctx context.Context, imageID, userID string) (int, error) {
+	_, err := DB.ExecContext(ctx,
+		`INSERT INTO image_likes (user_id, image_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		userID, imageID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return imageLikeCount(ctx, imageID)
+}
+
+// UnlikeImage removes userID's like from an image, if any, returning its
+// like count
+func UnlikeImage(ctx context.Context, imageID, userID string) (int, error) {
+	_, err := DB.ExecContext(ctx,
+		`DELETE FROM image_likes WHERE user_id = $1 AND image_id = $2`,
+		userID, imageID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return imageLikeCount(ctx, imageID)
+}
+
+// imageLikeCount returns an image's like count, kept up to date by the
+// image_likes triggers
+func imageLikeCount(ctx context.Context, imageID string) (int, error) {
+	var n int
+	err := DB.QueryRowContext(ctx, "SELECT like_count FROM images WHERE id = $1", imageID).Scan(&n)
+	return n, err
+}
+
+// ListLikedImages returns the images userID has liked and can still see,
+// most recently liked first, and their total
+func ListLikedImages(ctx context.Context, userID string, limit, offset int) ([]ImageInfo, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	// Private images stay visible to their owner and through shared albums
+	where := `WHERE l.user_id = $1 AND i.deleted_at IS NULL
+		   AND (i.visibility <> 'private' OR i.owner_id = $1 OR ` + inSharedAlbum("$1") + `)`
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM image_likes l JOIN images i ON l.image_id = i.id `+where,
+		userID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+imageInfoColumns+`
+		 FROM image_likes l
+		 JOIN images i ON l.image_id = i.id
+		 JOIN users u ON i.owner_id = u.id
+		 `+where+`
+		 ORDER BY l.created_at DESC, l.image_id
+		 LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var images []ImageInfo
+	for rows.Next() {
+		img := ImageInfo{LikedByMe: true}
+		if err := rows.Scan(img.fields()...); err != nil {
+			return nil, 0, err
+		}
+		images = append(images, img)
+	}
+	return images, total, rows.Err()
+}
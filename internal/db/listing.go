@@ -0,0 +1,273 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Image listing sort orders
+const (
+	SortNewest     = "newest"
+	SortOldest     = "oldest"
+	SortTitle      = "title"
+	SortMostViewed = "most_viewed"
+	SortMostLiked  = "most_liked"
+)
+
+// imageSort describes how to order a listing: by key (cast to keyType when
+// compared with a cursor), then by ID to break ties
+type imageSort struct {
+	key     string
+	keyType string
+	desc    bool
+}
+
+var imageSorts = map[string]imageSort{
+	SortNewest:     {key: "i.created_at", keyType: "timestamptz", desc: true},
+	SortOldest:     {key: "i.created_at", keyType: "timestamptz"},
+	SortTitle:      {key: "COALESCE(i.title, '')", keyType: "text"},
+	SortMostViewed: {key: "i.view_count", keyType: "bigint", desc: true},
+	SortMostLiked:  {key: "i.like_count", keyType: "integer", desc: true},
+}
+
+// ValidImageSort reports whether sort is a known sort order
+func ValidImageSort(sort string) bool {
+	_, ok := imageSorts[sort]
+	return ok
+}
+
+// ImageCursor is the position of an image in a sorted listing: its sort key
+// (as text) and ID
+type ImageCursor struct {
+	Key string
+	ID  string
+}
+
+// timestamptzLayouts parse timestamptz values as Postgres prints them,
+// with whole-hour, minute or second UTC offsets
+var timestamptzLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+}
+
+// ValidImageCursor reports whether a cursor's key and ID are well-formed
+// for a listing sorted by sort, so that a forged or corrupted cursor is
+// rejected rather than failing the listing query
+func ValidImageCursor(sort string, c ImageCursor) bool {
+	if sort == "" {
+		sort = SortNewest
+	}
+	s, ok := imageSorts[sort]
+	if !ok || !ValidUUID(c.ID) {
+		return false
+	}
+	switch s.keyType {
+	case "timestamptz":
+		for _, layout := range timestamptzLayouts {
+			if _, err := time.Parse(layout, c.Key); err == nil {
+				return true
+			}
+		}
+		return false
+	case "bigint", "integer":
+		bits := 64
+		if s.keyType == "integer" {
+			bits = 32
+		}
+		_, err := strconv.ParseInt(c.Key, 10, bits)
+		return err == nil
+	}
+	return utf8.ValidString(c.Key) && !strings.ContainsRune(c.Key, 0)
+}
+
+// ImagePage selects a page of an image listing
+type ImagePage struct {
+	// Sort is one of the Sort constants; "" is SortNewest
+	Sort  string
+	Limit int
+	// After continues a listing after the given image (keyset pagination);
+	// when set, Offset is ignored. It must come from a listing with the
+	// same Sort.
+	After  *ImageCursor
+	Offset int
+	// WithTotal also counts every matching image, which scans them all
+	WithTotal bool
+	// OmitThumbnails leaves ImageInfo.Thumbnail nil, saving bandwidth
+	OmitThumbnails bool
+	// ViewerID, if set, fills in ImageInfo.LikedByMe for that user
+	ViewerID string
+}
+
+// ImageFilter restricts an image listing. Zero fields don't filter.
+type ImageFilter struct {
+	OwnerIDs       []string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	ContentType    string
+	HasDescription *bool
+	MinWidth       int
+	MinHeight      int
+	// DominantColor is one of the imaging Color names
+	DominantColor string
+}
+
+// ListImages returns a page of public images (the gallery) matching filter,
+// a cursor for the next page (nil on the last page) and, if requested, the
+// total
+func ListImages(ctx context.Context, filter ImageFilter, page ImagePage) ([]ImageInfo, *ImageCursor, int, error) {
+	return listImages(ctx, true, filter, page)
+}
+
+// ListImagesByOwner returns a page of images owned by a specific user, like
+// ListImages
+func ListImagesByOwner(ctx context.Context, ownerID string, page ImagePage) ([]ImageInfo, *ImageCursor, int, error) {
+	return listImages(ctx, false, ImageFilter{OwnerIDs: []string{ownerID}}, page)
+}
+
+// listImages pages through images matching filter (and public ones only,
+// if publicOnly). Rows are ordered by the sort key and then ID, so a cursor
+// identifies a unique position even when keys tie.
+func listImages(ctx context.Context, publicOnly bool, filter ImageFilter, page ImagePage) ([]ImageInfo, *ImageCursor, int, error) {
+	if page.Limit <= 0 || page.Limit > 100 {
+		page.Limit = 50
+	}
+	if page.Sort == "" {
+		page.Sort = SortNewest
+	}
+	sort, ok := imageSorts[page.Sort]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("unknown sort %q", page.Sort)
+	}
+
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	conds := []string{"i.deleted_at IS NULL"}
+	if publicOnly {
+		conds = append(conds, "i.visibility = 'public'")
+	}
+	if len(filter.OwnerIDs) > 0 {
+		conds = append(conds, "i.owner_id = ANY("+arg(pq.Array(filter.OwnerIDs))+"::uuid[])")
+	}
+	if filter.CreatedAfter != nil {
+		conds = append(conds, "i.created_at >= "+arg(*filter.CreatedAfter))
+	}
+	if filter.CreatedBefore != nil {
+		conds = append(conds, "i.created_at < "+arg(*filter.CreatedBefore))
+	}
+	if filter.ContentType != "" {
+		conds = append(conds, "i.content_type = "+arg(filter.ContentType))
+	}
+	if filter.HasDescription != nil {
+		conds = append(conds, "(COALESCE(i.description, '') <> '') = "+arg(*filter.HasDescription))
+	}
+	if filter.MinWidth > 0 {
+		conds = append(conds, "i.width >= "+arg(filter.MinWidth))
+	}
+	if filter.MinHeight > 0 {
+		conds = append(conds, "i.height >= "+arg(filter.MinHeight))
+	}
+	if filter.DominantColor != "" {
+		conds = append(conds, "i.dominant_color = "+arg(filter.DominantColor))
+	}
+
+	var total int
+	if page.WithTotal {
+		err := DB.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM images i WHERE "+strings.Join(conds, " AND "),
+			args...,
+		).Scan(&total)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	cmp, dir := ">", "ASC"
+	if sort.desc {
+		cmp, dir = "<", "DESC"
+	}
+	offset := page.Offset
+	if page.After != nil {
+		conds = append(conds, fmt.Sprintf("(%s, i.id) %s (%s::%s, %s::uuid)",
+			sort.key, cmp, arg(page.After.Key), sort.keyType, arg(page.After.ID)))
+		offset = 0
+	}
+
+	columns := imageInfoColumns
+	if page.OmitThumbnails {
+		columns = strings.Replace(columns, "i.thumbnail", "NULL::bytea", 1)
+	}
+	likedByMe := "false"
+	if page.ViewerID != "" {
+		likedByMe = "EXISTS (SELECT 1 FROM image_likes l WHERE l.image_id = i.id AND l.user_id = " + arg(page.ViewerID) + "::uuid)"
+	}
+
+	// Fetch one extra row to learn whether there is a next page
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+columns+`, `+likedByMe+`, (`+sort.key+`)::text
+		 FROM images i
+		 JOIN users u ON i.owner_id = u.id
+		 WHERE `+strings.Join(conds, " AND ")+`
+		 ORDER BY `+sort.key+` `+dir+`, i.id `+dir+`
+		 LIMIT `+arg(page.Limit+1)+` OFFSET `+arg(offset),
+		args...,
+	)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer rows.Close()
+
+	var images []ImageInfo
+	var keys []string
+	for rows.Next() {
+		var img ImageInfo
+		var key string
+		if err := rows.Scan(append(img.fields(), &img.LikedByMe, &key)...); err != nil {
+			return nil, nil, 0, err
+		}
+		images = append(images, img)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, 0, err
+	}
+
+	var next *ImageCursor
+	if len(images) > page.Limit {
+		images = images[:page.Limit]
+		next = &ImageCursor{Key: keys[page.Limit-1], ID: images[page.Limit-1].ID}
+	}
+	return images, next, total, nil
+}
+
+// imageViewWindow is how long repeat views of an image by the same viewer
+// go uncounted
+const imageViewWindow = 24 * time.Hour
+
+// RecordImageView counts one view of an image by viewer (a user ID, or an
+// "ip:" key for anonymous viewers), unless viewer's last counted view was
+// within imageViewWindow. Repeat views then write nothing, so reloading a
+// page can't inflate the count.
+func RecordImageView(ctx context.Context, imageID, viewer string) error {
+	_, err := DB.ExecContext(ctx,
+		`WITH counted AS (
+		     INSERT INTO image_views (image_id, viewer) VALUES ($1, $2)
+		     ON CONFLICT (image_id, viewer) DO UPDATE SET viewed_at = NOW()
+		     WHERE image_views.viewed_at <= NOW() - make_interval(secs => $3)
+		     RETURNING 1
+		 )
+		 UPDATE images SET view_count = view_count + 1
+		 WHERE id = $1 AND EXISTS (SELECT 1 FROM counted)`,
+		imageID, viewer, imageViewWindow.Seconds(),
+	)
+	return err
+}
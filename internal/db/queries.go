@@ -3,14 +3,37 @@ package db
 import (
 	"context"
 	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// User roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Image visibility levels
+const (
+	// VisibilityPublic images appear in the gallery, tag listings and search
+	VisibilityPublic = "public"
+	// VisibilityUnlisted images are viewable by anyone with the ID but not listed
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPrivate images are viewable only by the owner and members of
+	// albums containing them
+	VisibilityPrivate = "private"
 )
 
 // User represents a user record from the database
 type User struct {
-	ID           string
-	Email        string
-	PasswordHash string
-	DisplayName  string
+	ID              string
+	Email           string
+	PasswordHash    string
+	DisplayName     string
+	MetadataPrivacy string
+	Role            string
+	// DefaultVisibility applies to uploads that don't choose a visibility
+	DefaultVisibility string
 }
 
 // EmailExists checks if a user with the given email already exists
@@ -69,9 +92,9 @@ func EmailExistsExcluding(ctx context.Context, email, excludeUserID string) (boo
 func GetUserByEmail(ctx context.Context, email string) (*User, error) {
 	var u User
 	err := DB.QueryRowContext(ctx,
-		"SELECT id, email, password_hash, display_name FROM users WHERE email = $1",
+		"SELECT id, email, password_hash, display_name, metadata_privacy, role, default_visibility FROM users WHERE email = $1",
 		email,
-	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.DisplayName)
+	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.DisplayName, &u.MetadataPrivacy, &u.Role, &u.DefaultVisibility)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -85,9 +108,9 @@ func GetUserByEmail(ctx context.Context, email string) (*User, error) {
 func GetUserByID(ctx context.Context, id string) (*User, error) {
 	var u User
 	err := DB.QueryRowContext(ctx,
-		"SELECT id, email, password_hash, display_name FROM users WHERE id = $1",
+		"SELECT id, email, password_hash, display_name, metadata_privacy, role, default_visibility FROM users WHERE id = $1",
 		id,
-	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.DisplayName)
+	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.DisplayName, &u.MetadataPrivacy, &u.Role, &u.DefaultVisibility)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -108,10 +131,12 @@ func CreateUser(ctx context.Context, email, passwordHash, displayName string) (s
 }
 
 // UpdateUser updates user fields
-func UpdateUser(ctx context.Context, userID, displayName, email, passwordHash string) error {
+func UpdateUser(ctx context.Context, userID, displayName, email, passwordHash, metadataPrivacy, defaultVisibility string) error {
 	_, err := DB.ExecContext(ctx,
-		"UPDATE users SET display_name = $1, email = $2, password_hash = $3, updated_at = NOW() WHERE id = $4",
-		displayName, email, passwordHash, userID,
+		`UPDATE users SET display_name = $1, email = $2, password_hash = $3, metadata_privacy = $4,
+		        default_visibility = $5, updated_at = NOW()
+		 WHERE id = $6`,
+		displayName, email, passwordHash, metadataPrivacy, defaultVisibility, userID,
 	)
 	return err
 }
@@ -132,6 +157,31 @@ type Image struct {
 	Description      string
 	CreatedAt        string
 	UpdatedAt        string
+	// MetadataPrivacy is the image's own setting ("" inherits OwnerMetadataPrivacy)
+	MetadataPrivacy      string
+	OwnerMetadataPrivacy string
+	Width                int
+	Height               int
+	ProcessingStatus     string
+	ProcessingError      string
+	Tags                 []string
+	Visibility           string
+	// Trashed images are hidden from everyone until restored
+	Trashed bool
+	// ContentVersion is bumped each time the content is replaced
+	ContentVersion int
+	// MetadataVersion is bumped each time the metadata changes
+	MetadataVersion int
+	// Edits is the JSON edit recipe applied when rendering, nil for none
+	Edits []byte
+}
+
+// EffectiveMetadataPrivacy returns the privacy level that applies to the image
+func (img *Image) EffectiveMetadataPrivacy() string {
+	if img.MetadataPrivacy != "" {
+		return img.MetadataPrivacy
+	}
+	return img.OwnerMetadataPrivacy
 }
 
 // ImageInfo represents image metadata with thumbnail for gallery display
@@ -143,17 +193,73 @@ type ImageInfo struct {
 	Title            string
 	CreatedAt        string
 	Thumbnail        []byte
+	Visibility       string
+	// Placeholders, empty until the image is processed
+	BlurHash      string
+	LQIP          string
+	Palette       []string
+	DominantColor string
+	LikeCount     int
+	// LikedByMe is only set by listings given a viewer
+	LikedByMe bool
+}
+
+// imageInfoColumns selects an ImageInfo from images i joined with users u,
+// in the order of ImageInfo.fields
+const imageInfoColumns = `i.id, i.owner_id, COALESCE(u.display_name, u.email) as owner_name,
+		        i.filename, COALESCE(i.title, ''), i.created_at::text, i.thumbnail, i.visibility,
+		        COALESCE(i.blurhash, ''), COALESCE(i.lqip, ''), i.palette, COALESCE(i.dominant_color, ''),
+		        i.like_count`
+
+// fields returns the scan destinations for imageInfoColumns
+func (img *ImageInfo) fields() []any {
+	return []any{&img.ID, &img.OwnerID, &img.OwnerDisplayName, &img.Filename, &img.Title, &img.CreatedAt, &img.Thumbnail, &img.Visibility,
+		&img.BlurHash, &img.LQIP, pq.Array(&img.Palette), &img.DominantColor, &img.LikeCount}
 }
 
-// CreateImage inserts a new image with thumbnail and returns the generated ID
-func CreateImage(ctx context.Context, ownerID, filename, contentType string, data, thumbnail []byte, title, description string) (string, error) {
+// CreateImage stores the image bytes as a (possibly shared) blob, inserts a
+// new image with its tags and queues its processing job in one transaction,
+// returning the generated ID. An empty metadataPrivacy inherits the owner's
+// default; an empty visibility is set from the owner's default visibility.
+// It fails with ErrStorageQuotaExceeded or ErrImageQuotaExceeded if the
+// image doesn't fit the owner's quota.
+func CreateImage(ctx context.Context, ownerID, filename, contentType string, data []byte, title, description, metadataPrivacy, visibility string, tags []string, jobPayload []byte) (string, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if err := reserveQuota(ctx, tx, ownerID, int64(len(data)), 1); err != nil {
+		return "", err
+	}
+	hash, err := acquireBlob(ctx, tx, data)
+	if err != nil {
+		return "", err
+	}
+
 	var imageID string
-	err := DB.QueryRowContext(ctx,
-		`INSERT INTO images (owner_id, filename, content_type, data, thumbnail, title, description) 
-		 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
-		ownerID, filename, contentType, data, thumbnail, title, description,
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO images (owner_id, filename, content_type, blob_sha256, upload_sha256, title, description, metadata_privacy, visibility) 
+		 VALUES ($1, $2, $3, $4, $4, $5, $6, NULLIF($7, ''),
+		         COALESCE(NULLIF($8, ''), (SELECT default_visibility FROM users WHERE id = $1))) RETURNING id`,
+		ownerID, filename, contentType, hash, title, description, metadataPrivacy, visibility,
 	).Scan(&imageID)
-	return imageID, err
+	if err != nil {
+		return "", err
+	}
+	if len(tags) > 0 {
+		if err := setImageTags(ctx, tx, imageID, tags); err != nil {
+			return "", err
+		}
+	}
+	if err := recordRevisions(ctx, tx, []string{imageID}, ownerID); err != nil {
+		return "", err
+	}
+	if err := enqueueJob(ctx, tx, JobProcessImage, imageID, jobPayload); err != nil {
+		return "", err
+	}
+	return imageID, tx.Commit()
 }
 
 // GetImageByID fetches a single image with owner info
@@ -161,14 +267,21 @@ func GetImageByID(ctx context.Context, id string) (*Image, error) {
 	var img Image
 	err := DB.QueryRowContext(ctx,
 		`SELECT i.id, i.owner_id, COALESCE(u.display_name, u.email) as owner_name,
-		        i.filename, i.content_type, i.data, COALESCE(i.title, ''), COALESCE(i.description, ''),
-		        i.created_at::text
+		        i.filename, i.content_type, b.data, COALESCE(i.title, ''), COALESCE(i.description, ''),
+		        i.created_at::text, COALESCE(i.metadata_privacy, ''), u.metadata_privacy,
+		        COALESCE(i.width, 0), COALESCE(i.height, 0), i.processing_status, COALESCE(i.processing_error, ''),
+		        ARRAY(SELECT t.name FROM image_tags it JOIN tags t ON it.tag_id = t.id
+		              WHERE it.image_id = i.id ORDER BY t.name),
+		        i.visibility, i.deleted_at IS NOT NULL, i.content_version, i.metadata_version, i.edits
 		 FROM images i
 		 JOIN users u ON i.owner_id = u.id
+		 JOIN blobs b ON i.blob_sha256 = b.sha256
 		 WHERE i.id = $1`,
 		id,
 	).Scan(&img.ID, &img.OwnerID, &img.OwnerDisplayName, &img.Filename, &img.ContentType,
-		&img.Data, &img.Title, &img.Description, &img.CreatedAt)
+		&img.Data, &img.Title, &img.Description, &img.CreatedAt, &img.MetadataPrivacy, &img.OwnerMetadataPrivacy,
+		&img.Width, &img.Height, &img.ProcessingStatus, &img.ProcessingError, pq.Array(&img.Tags),
+		&img.Visibility, &img.Trashed, &img.ContentVersion, &img.MetadataVersion, &img.Edits)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -178,104 +291,52 @@ func GetImageByID(ctx context.Context, id string) (*Image, error) {
 	return &img, nil
 }
 
-// ListImages returns all images (public gallery)
-func ListImages(ctx context.Context, limit, offset int) ([]ImageInfo, int, error) {
-	if limit <= 0 || limit > 100 {
-		limit = 50
-	}
-
-	// Get total count
-	var total int
-	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM images").Scan(&total)
+// UpdateImage updates image metadata on behalf of editorID (owner must be
+// verified by caller), recording a revision if anything changed. tags
+// replaces the image's tags unless it is nil. If expectedVersion is set the
+// update only applies while the image is still at that metadata version.
+// It returns the new metadata version, or 0 if the image doesn't exist, is
+// trashed or has changed since expectedVersion.
+func UpdateImage(ctx context.Context, imageID, editorID, title, description, metadataPrivacy, visibility string, tags []string, expectedVersion *int) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	rows, err := DB.QueryContext(ctx,
-		`SELECT i.id, i.owner_id, COALESCE(u.display_name, u.email) as owner_name,
-		        i.filename, COALESCE(i.title, ''), i.created_at::text, i.thumbnail
-		 FROM images i
-		 JOIN users u ON i.owner_id = u.id
-		 ORDER BY i.created_at DESC
-		 LIMIT $1 OFFSET $2`,
-		limit, offset,
+	res, err := tx.ExecContext(ctx,
+		`UPDATE images SET title = $1, description = $2, metadata_privacy = NULLIF($3, ''), visibility = $4, updated_at = NOW()
+		 WHERE id = $5 AND deleted_at IS NULL AND ($6::int IS NULL OR metadata_version = $6)`,
+		title, description, metadataPrivacy, visibility, imageID, expectedVersion,
 	)
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
-	defer rows.Close()
-
-	var images []ImageInfo
-	for rows.Next() {
-		var img ImageInfo
-		if err := rows.Scan(&img.ID, &img.OwnerID, &img.OwnerDisplayName, &img.Filename, &img.Title, &img.CreatedAt, &img.Thumbnail); err != nil {
-			return nil, 0, err
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, err
+	}
+	if tags != nil {
+		if err := setImageTags(ctx, tx, imageID, tags); err != nil {
+			return 0, err
 		}
-		images = append(images, img)
 	}
-	return images, total, rows.Err()
-}
-
-// ListImagesByOwner returns images owned by a specific user
-func ListImagesByOwner(ctx context.Context, ownerID string, limit, offset int) ([]ImageInfo, int, error) {
-	if limit <= 0 || limit > 100 {
-		limit = 50
+	if err := recordRevisions(ctx, tx, []string{imageID}, editorID); err != nil {
+		return 0, err
 	}
 
-	var total int
-	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM images WHERE owner_id = $1", ownerID).Scan(&total)
-	if err != nil {
-		return nil, 0, err
+	var version int
+	if err := tx.QueryRowContext(ctx, "SELECT metadata_version FROM images WHERE id = $1", imageID).Scan(&version); err != nil {
+		return 0, err
 	}
-
-	rows, err := DB.QueryContext(ctx,
-		`SELECT i.id, i.owner_id, COALESCE(u.display_name, u.email) as owner_name,
-		        i.filename, COALESCE(i.title, ''), i.created_at::text, i.thumbnail
-		 FROM images i
-		 JOIN users u ON i.owner_id = u.id
-		 WHERE i.owner_id = $2
-		 ORDER BY i.created_at DESC
-		 LIMIT $1 OFFSET $3`,
-		limit, ownerID, offset,
-	)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer rows.Close()
-
-	var images []ImageInfo
-	for rows.Next() {
-		var img ImageInfo
-		if err := rows.Scan(&img.ID, &img.OwnerID, &img.OwnerDisplayName, &img.Filename, &img.Title, &img.CreatedAt, &img.Thumbnail); err != nil {
-			return nil, 0, err
-		}
-		images = append(images, img)
-	}
-	return images, total, rows.Err()
-}
-
-// UpdateImage updates image metadata (owner must be verified by caller)
-func UpdateImage(ctx context.Context, imageID, title, description string) error {
-	_, err := DB.ExecContext(ctx,
-		"UPDATE images SET title = $1, description = $2, updated_at = NOW() WHERE id = $3",
-		title, description, imageID,
-	)
-	return err
-}
-
-// DeleteImage removes an image (owner must be verified by caller)
-func DeleteImage(ctx context.Context, imageID string) error {
-	_, err := DB.ExecContext(ctx, "DELETE FROM images WHERE id = $1", imageID)
-	return err
+	return version, tx.Commit()
 }
 
 // GetImageOwner returns the owner_id for an image
 func GetImageOwner(ctx context.Context, imageID string) (string, error) {
 	var ownerID string
-	err := DB.QueryRowContext(ctx, "SELECT owner_id FROM images WHERE id = $1", imageID).Scan(&ownerID)
+	err := DB.QueryRowContext(ctx, "SELECT owner_id FROM images WHERE id = $1 AND deleted_at IS NULL", imageID).Scan(&ownerID)
 	if err == sql.ErrNoRows {
 		return "", nil
 	}
 	return ownerID, err
 }
-
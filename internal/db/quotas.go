@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Errors returned by writes that would take an owner over their quota
+var (
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+	ErrImageQuotaExceeded   = errors.New("image quota exceeded")
+)
+
+// Usage is what a user stores against their quota. Every image and every
+// earlier version counts at full size, even when its bytes are shared with
+// another image, and trashed images count until they are purged.
+type Usage struct {
+	Bytes      int64
+	Images     int
+	MaxBytes   int64 // 0 is unlimited
+	MaxImages  int   // 0 is unlimited
+	Overridden bool  // the limits are a per-user override rather than the role's
+}
+
+// usageQuery selects a user's Usage from users u, in the order of
+// Usage.fields. A user_quotas row replaces both of the role's limits.
+const usageQuery = `
+	SELECT (SELECT COALESCE(SUM(b.size), 0) FROM images i JOIN blobs b ON i.blob_sha256 = b.sha256
+	        WHERE i.owner_id = u.id) +
+	       (SELECT COALESCE(SUM(b.size), 0) FROM image_versions v
+	        JOIN images i ON v.image_id = i.id
+	        JOIN blobs b ON v.blob_sha256 = b.sha256
+	        WHERE i.owner_id = u.id),
+	       (SELECT COUNT(*) FROM images WHERE owner_id = u.id),
+	       COALESCE(CASE WHEN q.user_id IS NULL THEN r.max_bytes ELSE q.max_bytes END, 0),
+	       COALESCE(CASE WHEN q.user_id IS NULL THEN r.max_images ELSE q.max_images END, 0),
+	       q.user_id IS NOT NULL
+	FROM users u
+	LEFT JOIN user_quotas q ON q.user_id = u.id
+	LEFT JOIN role_quotas r ON r.role = u.role
+	WHERE u.id = $1`
+
+// fields returns the scan destinations for usageQuery
+func (u *Usage) fields() []any {
+	return []any{&u.Bytes, &u.Images, &u.MaxBytes, &u.MaxImages, &u.Overridden}
+}
+
+// GetUsage returns a user's storage usage and limits, or nil if the user
+// doesn't exist
+func GetUsage(ctx context.Context, userID string) (*Usage, error) {
+	var u Usage
+	err := DB.QueryRowContext(ctx, usageQuery, userID).Scan(u.fields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// reserveQuota checks that ownerID can store addBytes and addImages more,
+// returning ErrStorageQuotaExceeded or ErrImageQuotaExceeded if not. It
+// locks the owner's row so concurrent writes by the same owner are checked
+// one at a time, and must run inside the caller's transaction before it
+// adds the content.
+func reserveQuota(ctx context.Context, tx *sql.Tx, ownerID string, addBytes int64, addImages int) error {
+	var u Usage
+	err := tx.QueryRowContext(ctx, usageQuery+` FOR UPDATE OF u`, ownerID).Scan(u.fields()...)
+	if err != nil {
+		return err
+	}
+	if u.MaxImages > 0 && u.Images+addImages > u.MaxImages {
+		return ErrImageQuotaExceeded
+	}
+	if u.MaxBytes > 0 && u.Bytes+addBytes > u.MaxBytes {
+		return ErrStorageQuotaExceeded
+	}
+	return nil
+}
+
+// SetUserQuota overrides a user's role limits (0 is unlimited), reporting
+// whether the user exists
+func SetUserQuota(ctx context.Context, userID string, maxBytes int64, maxImages int) (bool, error) {
+	res, err := DB.ExecContext(ctx,
+		`INSERT INTO user_quotas (user_id, max_bytes, max_images)
+		 SELECT id, NULLIF($2, 0), NULLIF($3, 0) FROM users WHERE id = $1
+		 ON CONFLICT (user_id) DO UPDATE
+		 SET max_bytes = EXCLUDED.max_bytes, max_images = EXCLUDED.max_images, updated_at = NOW()`,
+		userID, maxBytes, maxImages,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClearUserQuota removes a user's override so their role's limits apply again
+func ClearUserQuota(ctx context.Context, userID string) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM user_quotas WHERE user_id = $1", userID)
+	return err
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// ImageRevision is the metadata an image had after one change, along with
+// what it had before
+type ImageRevision struct {
+	Version                 int
+	EditedBy                string // "" if the editor's account was deleted
+	EditedByDisplayName     string
+	CreatedAt               string
+	Title                   string
+	Description             string
+	MetadataPrivacy         string // the image's own setting; "" inherits
+	Visibility              string
+	Tags                    []string
+	PreviousTitle           string // previous values are empty for the first revision
+	PreviousDescription     string
+	PreviousMetadataPrivacy string
+	PreviousVisibility      string
+	PreviousTags            []string
+}
+
+// recordRevisions snapshots the current metadata of each image whose
+// metadata differs from its latest revision, bumping its metadata_version.
+// It must run inside the caller's transaction, after the changes.
+func recordRevisions(ctx context.Context, tx *sql.Tx, imageIDs []string, editorID string) error {
+	_, err := tx.ExecContext(ctx,
+		`WITH snap AS (
+		     SELECT i.id, i.metadata_version, i.title, i.description, i.metadata_privacy, i.visibility,
+		            ARRAY(SELECT t.name FROM image_tags it JOIN tags t ON it.tag_id = t.id
+		                  WHERE it.image_id = i.id ORDER BY t.name) AS tags
+		     FROM images i WHERE i.id = ANY($1::uuid[])
+		 ), changed AS (
+		     SELECT s.* FROM snap s
+		     WHERE NOT EXISTS (
+		         SELECT 1 FROM image_revisions r
+		         WHERE r.image_id = s.id AND r.version = s.metadata_version
+		           AND (r.title, r.description, r.metadata_privacy, r.visibility, r.tags)
+		               IS NOT DISTINCT FROM (s.title, s.description, s.metadata_privacy, s.visibility, s.tags)
+		     )
+		 ), bumped AS (
+		     UPDATE images i SET metadata_version = i.metadata_version + 1
+		     FROM changed c WHERE i.id = c.id
+		     RETURNING i.id, i.metadata_version
+		 )
+		 INSERT INTO image_revisions (image_id, version, edited_by, title, description, metadata_privacy, visibility, tags)
+		 SELECT c.id, b.metadata_version, NULLIF($2, '')::uuid, c.title, c.description, c.metadata_privacy, c.visibility, c.tags
+		 FROM changed c JOIN bumped b ON b.id = c.id`,
+		pq.Array(imageIDs), editorID,
+	)
+	return err
+}
+
+// imageRevisionColumns selects an ImageRevision from the revisions subquery
+// r (which adds the prev_* columns) joined with users u
+const imageRevisionColumns = `r.version, COALESCE(r.edited_by::text, ''), COALESCE(u.display_name, u.email, ''),
+	r.created_at::text, COALESCE(r.title, ''), COALESCE(r.description, ''),
+	COALESCE(r.metadata_privacy, ''), r.visibility, r.tags,
+	COALESCE(r.prev_title, ''), COALESCE(r.prev_description, ''),
+	COALESCE(r.prev_metadata_privacy, ''), COALESCE(r.prev_visibility, ''), COALESCE(r.prev_tags, '{}')`
+
+// imageRevisionsWithPrevious pairs each revision of image $1 with the
+// values of the one before it
+const imageRevisionsWithPrevious = `(
+	SELECT *,
+	       LAG(title) OVER w AS prev_title, LAG(description) OVER w AS prev_description,
+	       LAG(metadata_privacy) OVER w AS prev_metadata_privacy, LAG(visibility) OVER w AS prev_visibility,
+	       LAG(tags) OVER w AS prev_tags
+	FROM image_revisions WHERE image_id = $1
+	WINDOW w AS (ORDER BY version)
+) r LEFT JOIN users u ON r.edited_by = u.id`
+
+// scanImageRevision scans a row selected with imageRevisionColumns
+func scanImageRevision(row interface{ Scan(...any) error }, r *ImageRevision) error {
+	return row.Scan(&r.Version, &r.EditedBy, &r.EditedByDisplayName, &r.CreatedAt,
+		&r.Title, &r.Description, &r.MetadataPrivacy, &r.Visibility, pq.Array(&r.Tags),
+		&r.PreviousTitle, &r.PreviousDescription, &r.PreviousMetadataPrivacy, &r.PreviousVisibility,
+		pq.Array(&r.PreviousTags))
+}
+
+// ListImageRevisions returns an image's metadata revisions, newest first
+func ListImageRevisions(ctx context.Context, imageID string, limit, offset int) ([]ImageRevision, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM image_revisions WHERE image_id = $1",
+		imageID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+imageRevisionColumns+`
+		 FROM `+imageRevisionsWithPrevious+`
+		 ORDER BY r.version DESC
+		 LIMIT $2 OFFSET $3`,
+		imageID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var revisions []ImageRevision
+	for rows.Next() {
+		var r ImageRevision
+		if err := scanImageRevision(rows, &r); err != nil {
+			return nil, 0, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, total, rows.Err()
+}
+
+// GetImageRevision returns one revision of an image's metadata
+func GetImageRevision(ctx context.Context, imageID string, version int) (*ImageRevision, error) {
+	var r ImageRevision
+	err := scanImageRevision(DB.QueryRowContext(ctx,
+		`SELECT `+imageRevisionColumns+`
+		 FROM `+imageRevisionsWithPrevious+`
+		 WHERE r.version = $2`,
+		imageID, version,
+	), &r)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
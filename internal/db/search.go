@@ -0,0 +1,150 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// defaultSearchLanguage is the text search configuration used when
+// SEARCH_LANGUAGE is not set
+const defaultSearchLanguage = "english"
+
+// Highlight delimiters returned by SearchImages. They are Unicode
+// private-use characters, which never occur in user text.
+const (
+	HighlightStart = "\uE000"
+	HighlightStop  = "\uE001"
+)
+
+// InitSearch applies the text search configuration named by SEARCH_LANGUAGE
+// (a Postgres configuration such as "english", "german" or "simple"). If it
+// differs from the one the index was built with, every image is re-indexed.
+func InitSearch(ctx context.Context) error {
+	language := os.Getenv("SEARCH_LANGUAGE")
+	if language == "" {
+		language = defaultSearchLanguage
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM pg_ts_config WHERE cfgname = $1)", language,
+	).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("unknown SEARCH_LANGUAGE %q", language)
+	}
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE search_settings SET config = $1::regconfig WHERE config <> $1::regconfig",
+		language,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE images SET search_vector = image_search_vector(id)"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SearchFilter narrows a search. Zero values match everything.
+type SearchFilter struct {
+	// ViewerID's own images are searched as well as public ones
+	ViewerID      string
+	OwnerID       string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	ContentType   string
+}
+
+// SearchResult is an image matching a search
+type SearchResult struct {
+	ImageInfo
+	Rank float64
+	// TitleHighlight and Snippet mark matched words with HighlightStart and
+	// HighlightStop. Snippet is a few fragments of the description.
+	TitleHighlight string
+	Snippet        string
+}
+
+// ts_headline options for the title (highlighted in full) and the
+// description (summarized to its best-matching fragments)
+var (
+	titleHeadline   = fmt.Sprintf(`HighlightAll=true, StartSel="%s", StopSel="%s"`, HighlightStart, HighlightStop)
+	snippetHeadline = fmt.Sprintf(`MaxFragments=2, MaxWords=20, MinWords=5, FragmentDelimiter=" … ", StartSel="%s", StopSel="%s"`, HighlightStart, HighlightStop)
+)
+
+// searchWhere is the WHERE clause shared by the search queries; it uses
+// parameters $1-$6 in the order of SearchImages' args
+const searchWhere = `
+	WHERE i.search_vector @@ websearch_to_tsquery(s.config, $1)
+	  AND (i.visibility = 'public' OR i.owner_id = NULLIF($6, '')::uuid)
+	  AND i.deleted_at IS NULL
+	  AND (NULLIF($2, '') IS NULL OR i.owner_id = NULLIF($2, '')::uuid)
+	  AND ($3::timestamptz IS NULL OR i.created_at >= $3)
+	  AND ($4::timestamptz IS NULL OR i.created_at < $4)
+	  AND (NULLIF($5, '') IS NULL OR i.content_type = $5)`
+
+// SearchImages finds images matching a web-style query ("quoted phrases",
+// OR, -excluded words) over titles, tags, descriptions and owner names, best
+// matches first
+func SearchImages(ctx context.Context, query string, filter SearchFilter, limit, offset int) ([]SearchResult, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	args := []any{query, filter.OwnerID, filter.CreatedAfter, filter.CreatedBefore, filter.ContentType, filter.ViewerID}
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM images i CROSS JOIN search_settings s"+searchWhere,
+		args...,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Rank and page first so headlines are only built for the returned rows
+	rows, err := DB.QueryContext(ctx,
+		`WITH page AS (
+		     SELECT i.id, ts_rank_cd(i.search_vector, websearch_to_tsquery(s.config, $1)) AS rank
+		     FROM images i CROSS JOIN search_settings s`+searchWhere+`
+		     ORDER BY rank DESC, i.created_at DESC, i.id
+		     LIMIT $7 OFFSET $8
+		 )
+		 SELECT `+imageInfoColumns+`, p.rank,
+		        ts_headline(s.config, COALESCE(i.title, ''), websearch_to_tsquery(s.config, $1), $9),
+		        ts_headline(s.config, COALESCE(i.description, ''), websearch_to_tsquery(s.config, $1), $10)
+		 FROM page p
+		 JOIN images i ON i.id = p.id
+		 JOIN users u ON i.owner_id = u.id
+		 CROSS JOIN search_settings s
+		 ORDER BY p.rank DESC, i.created_at DESC, i.id`,
+		append(args, limit, offset, titleHeadline, snippetHeadline)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(append(r.fields(), &r.Rank, &r.TitleHighlight, &r.Snippet)...); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, r)
+	}
+	return results, total, rows.Err()
+}
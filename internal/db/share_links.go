@@ -0,0 +1,169 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ShareLink is an unguessable link to one image or album
+type ShareLink struct {
+	ID             string
+	Token          string
+	CreatedBy      string
+	ImageID        string // exactly one of ImageID and AlbumID is set
+	AlbumID        string
+	PasswordHash   string // "" if the link has no password
+	ExpiresAt      string // "" if the link never expires
+	MaxViews       int    // 0 is unlimited
+	ViewCount      int
+	LastAccessedAt string
+	CreatedAt      string
+	Expired        bool
+}
+
+const shareLinkColumns = `
+	id, token, created_by, COALESCE(image_id::text, ''), COALESCE(album_id::text, ''),
+	COALESCE(password_hash, ''), COALESCE(expires_at::text, ''), COALESCE(max_views, 0), view_count,
+	COALESCE(last_accessed_at::text, ''), created_at::text, COALESCE(expires_at <= NOW(), false)`
+
+// scanShareLink scans a row selected with shareLinkColumns
+func scanShareLink(row interface{ Scan(...any) error }, l *ShareLink) error {
+	return row.Scan(&l.ID, &l.Token, &l.CreatedBy, &l.ImageID, &l.AlbumID,
+		&l.PasswordHash, &l.ExpiresAt, &l.MaxViews, &l.ViewCount,
+		&l.LastAccessedAt, &l.CreatedAt, &l.Expired)
+}
+
+// CreateShareLink stores a new link to an image or album (pass "" for the
+// other). A nil expiresAt never expires and maxViews 0 is unlimited.
+func CreateShareLink(ctx context.Context, token, createdBy, imageID, albumID, passwordHash string, expiresAt *time.Time, maxViews int) (*ShareLink, error) {
+	var l ShareLink
+	err := scanShareLink(DB.QueryRowContext(ctx,
+		`INSERT INTO share_links (token, created_by, image_id, album_id, password_hash, expires_at, max_views)
+		 VALUES ($1, $2, NULLIF($3, '')::uuid, NULLIF($4, '')::uuid, NULLIF($5, ''), $6, NULLIF($7, 0))
+		 RETURNING `+shareLinkColumns,
+		token, createdBy, imageID, albumID, passwordHash, expiresAt, maxViews,
+	), &l)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// GetShareLinkByToken retrieves a link by its token
+func GetShareLinkByToken(ctx context.Context, token string) (*ShareLink, error) {
+	var l ShareLink
+	err := scanShareLink(DB.QueryRowContext(ctx,
+		`SELECT `+shareLinkColumns+` FROM share_links WHERE token = $1`,
+		token,
+	), &l)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// ListShareLinks returns links created by a user, newest first, optionally
+// restricted to one image or album
+func ListShareLinks(ctx context.Context, createdBy, imageID, albumID string, limit, offset int) ([]ShareLink, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	const where = `WHERE created_by = $1
+		   AND ($2 = '' OR image_id = NULLIF($2, '')::uuid)
+		   AND ($3 = '' OR album_id = NULLIF($3, '')::uuid)`
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM share_links `+where,
+		createdBy, imageID, albumID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+shareLinkColumns+`
+		 FROM share_links `+where+`
+		 ORDER BY created_at DESC, id
+		 LIMIT $4 OFFSET $5`,
+		createdBy, imageID, albumID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		var l ShareLink
+		if err := scanShareLink(rows, &l); err != nil {
+			return nil, 0, err
+		}
+		links = append(links, l)
+	}
+	return links, total, rows.Err()
+}
+
+// RevokeShareLink deletes a link created by createdBy, reporting whether it
+// existed
+func RevokeShareLink(ctx context.Context, linkID, createdBy string) (bool, error) {
+	res, err := DB.ExecContext(ctx,
+		`DELETE FROM share_links WHERE id = $1 AND created_by = $2`,
+		linkID, createdBy,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RecordShareLinkAccess counts one access through a link. It returns false,
+// without counting, if the link has been revoked, has expired or has used
+// up its views; the check and increment are atomic so concurrent requests
+// cannot exceed max_views.
+func RecordShareLinkAccess(ctx context.Context, linkID string) (bool, error) {
+	res, err := DB.ExecContext(ctx,
+		`UPDATE share_links SET view_count = view_count + 1, last_accessed_at = NOW()
+		 WHERE id = $1
+		   AND (expires_at IS NULL OR expires_at > NOW())
+		   AND (max_views IS NULL OR view_count < max_views)`,
+		linkID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CreateShareLinkSession starts a browsing session of an album link,
+// identified by token and lasting ttl. Expired sessions are cleared out.
+func CreateShareLinkSession(ctx context.Context, linkID, token string, ttl time.Duration) error {
+	if _, err := DB.ExecContext(ctx, "DELETE FROM share_link_sessions WHERE expires_at <= NOW()"); err != nil {
+		return err
+	}
+	_, err := DB.ExecContext(ctx,
+		`INSERT INTO share_link_sessions (token, link_id, expires_at)
+		 VALUES ($1, $2, NOW() + make_interval(secs => $3))`,
+		token, linkID, ttl.Seconds(),
+	)
+	return err
+}
+
+// ShareLinkSessionValid reports whether token is an unexpired session of a
+// link. Revoking the link ends its sessions.
+func ShareLinkSessionValid(ctx context.Context, linkID, token string) (bool, error) {
+	var ok bool
+	err := DB.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM share_link_sessions
+		                WHERE token = $1 AND link_id = $2 AND expires_at > NOW())`,
+		token, linkID,
+	).Scan(&ok)
+	return ok, err
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+
+	"github.com/lib/pq"
+)
+
+// Perceptual hashes are unsigned 64-bit values stored bit-for-bit in a
+// BIGINT column, so they round-trip through int64
+
+// ForEachImageHash calls fn for every image that has a perceptual hash
+func ForEachImageHash(ctx context.Context, fn func(imageID string, hash uint64)) error {
+	rows, err := DB.QueryContext(ctx, "SELECT id, phash FROM images WHERE phash IS NOT NULL AND deleted_at IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var hash int64
+		if err := rows.Scan(&id, &hash); err != nil {
+			return err
+		}
+		fn(id, uint64(hash))
+	}
+	return rows.Err()
+}
+
+// GetImageHashes returns the perceptual hashes of the given images. Images
+// that don't exist or haven't been hashed yet are absent from the map.
+func GetImageHashes(ctx context.Context, imageIDs []string) (map[string]uint64, error) {
+	rows, err := DB.QueryContext(ctx,
+		"SELECT id, phash FROM images WHERE id = ANY($1::uuid[]) AND phash IS NOT NULL AND deleted_at IS NULL",
+		pq.Array(imageIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]uint64, len(imageIDs))
+	for rows.Next() {
+		var id string
+		var hash int64
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = uint64(hash)
+	}
+	return hashes, rows.Err()
+}
+
+// ListImagesByIDs returns summaries of the given images that are public or
+// owned by viewerID, in no particular order. Other images are skipped.
+func ListImagesByIDs(ctx context.Context, imageIDs []string, viewerID string) ([]ImageInfo, error) {
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+imageInfoColumns+`
+		 FROM images i
+		 JOIN users u ON i.owner_id = u.id
+		 WHERE i.id = ANY($1::uuid[])
+		   AND (i.visibility = 'public' OR i.owner_id = NULLIF($2, '')::uuid)
+		   AND i.deleted_at IS NULL`,
+		pq.Array(imageIDs), viewerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []ImageInfo
+	for rows.Next() {
+		var img ImageInfo
+		if err := rows.Scan(img.fields()...); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// TagCount is a tag and the number of images carrying it
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+// setImageTags replaces an image's tags. Tags must already be normalized.
+func setImageTags(ctx context.Context, tx *sql.Tx, imageID string, tags []string) error {
+	if tags == nil {
+		tags = []string{}
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO tags (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING",
+		pq.Array(tags),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM image_tags it USING tags t
+		 WHERE it.tag_id = t.id AND it.image_id = $1 AND t.name <> ALL($2::text[])`,
+		imageID, pq.Array(tags),
+	); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO image_tags (image_id, tag_id)
+		 SELECT $1, t.id FROM tags t WHERE t.name = ANY($2::text[])
+		 ON CONFLICT DO NOTHING`,
+		imageID, pq.Array(tags),
+	)
+	return err
+}
+
+// ListImagesByTag returns images carrying a tag that are public or owned
+// by viewerID, newest first
+func ListImagesByTag(ctx context.Context, tag, viewerID string, limit, offset int) ([]ImageInfo, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM image_tags it
+		 JOIN tags t ON it.tag_id = t.id
+		 JOIN images i ON it.image_id = i.id
+		 WHERE t.name = $1 AND (i.visibility = 'public' OR i.owner_id = NULLIF($2, '')::uuid)
+		   AND i.deleted_at IS NULL`,
+		tag, viewerID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+imageInfoColumns+`
+		 FROM tags t
+		 JOIN image_tags it ON it.tag_id = t.id
+		 JOIN images i ON it.image_id = i.id
+		 JOIN users u ON i.owner_id = u.id
+		 WHERE t.name = $2 AND (i.visibility = 'public' OR i.owner_id = NULLIF($4, '')::uuid)
+		   AND i.deleted_at IS NULL
+		 ORDER BY i.created_at DESC
+		 LIMIT $1 OFFSET $3`,
+		limit, tag, offset, viewerID,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var images []ImageInfo
+	for rows.Next() {
+		var img ImageInfo
+		if err := rows.Scan(img.fields()...); err != nil {
+			return nil, 0, err
+		}
+		images = append(images, img)
+	}
+	return images, total, rows.Err()
+}
+
+// ListTags returns tags in use, most used first, counting images that are
+// public or owned by viewerID. ownerID, if set, counts only that user's
+// images.
+func ListTags(ctx context.Context, ownerID, viewerID string, limit, offset int) ([]TagCount, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		`SELECT COUNT(DISTINCT it.tag_id) FROM image_tags it
+		 JOIN images i ON it.image_id = i.id
+		 WHERE (NULLIF($1, '') IS NULL OR i.owner_id = NULLIF($1, '')::uuid)
+		   AND (i.visibility = 'public' OR i.owner_id = NULLIF($2, '')::uuid)
+		   AND i.deleted_at IS NULL`,
+		ownerID, viewerID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT t.name, COUNT(*) AS n
+		 FROM tags t
+		 JOIN image_tags it ON it.tag_id = t.id
+		 JOIN images i ON it.image_id = i.id
+		 WHERE (NULLIF($2, '') IS NULL OR i.owner_id = NULLIF($2, '')::uuid)
+		   AND (i.visibility = 'public' OR i.owner_id = NULLIF($4, '')::uuid)
+		   AND i.deleted_at IS NULL
+		 GROUP BY t.name
+		 ORDER BY n DESC, t.name
+		 LIMIT $1 OFFSET $3`,
+		limit, ownerID, offset, viewerID,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	tags, err := scanTagCounts(rows)
+	return tags, total, err
+}
+
+// AutocompleteTags returns up to limit tags starting with prefix that are
+// used on images public or owned by viewerID, most used first
+func AutocompleteTags(ctx context.Context, prefix, viewerID string, limit int) ([]TagCount, error) {
+	if limit <= 0 || limit > 50 {
+		limit = 10
+	}
+
+	// Escape LIKE wildcards so the prefix matches literally
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT t.name, COUNT(*) AS n
+		 FROM tags t
+		 JOIN image_tags it ON it.tag_id = t.id
+		 JOIN images i ON it.image_id = i.id
+		 WHERE t.name LIKE $1 || '%'
+		   AND (i.visibility = 'public' OR i.owner_id = NULLIF($3, '')::uuid)
+		   AND i.deleted_at IS NULL
+		 GROUP BY t.name
+		 ORDER BY n DESC, t.name
+		 LIMIT $2`,
+		escaped, limit, viewerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanTagCounts(rows)
+}
+
+func scanTagCounts(rows *sql.Rows) ([]TagCount, error) {
+	defer rows.Close()
+
+	var tags []TagCount
+	for rows.Next() {
+		var t TagCount
+		if err := rows.Scan(&t.Name, &t.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TrashedImage is an image in its owner's trash
+type TrashedImage struct {
+	ImageInfo
+	DeletedAt string
+	PurgeAt   string // when the retention sweeper will delete it
+}
+
+// TrashImage moves an image to the trash (owner must be verified by
+// caller), reporting whether it was there to move
+func TrashImage(ctx context.Context, imageID string) (bool, error) {
+	trashed, err := TrashImages(ctx, []string{imageID})
+	return len(trashed) > 0, err
+}
+
+// TrashImages moves images to the trash (owner must be verified by caller)
+// in one statement, returning the IDs that were moved
+func TrashImages(ctx context.Context, imageIDs []string) ([]string, error) {
+	rows, err := DB.QueryContext(ctx,
+		`UPDATE images SET deleted_at = NOW()
+		 WHERE id = ANY($1::uuid[]) AND deleted_at IS NULL
+		 RETURNING id`,
+		pq.Array(imageIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trashed []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		trashed = append(trashed, id)
+	}
+	return trashed, rows.Err()
+}
+
+// RestoreImage takes an image out of its owner's trash, reporting whether
+// it was trashed
+func RestoreImage(ctx context.Context, imageID, ownerID string) (bool, error) {
+	res, err := DB.ExecContext(ctx,
+		"UPDATE images SET deleted_at = NULL WHERE id = $1 AND owner_id = $2 AND deleted_at IS NOT NULL",
+		imageID, ownerID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ListTrash returns a user's trashed images, most recently trashed first.
+// Images are purged once they have been in the trash for retention.
+func ListTrash(ctx context.Context, ownerID string, retention time.Duration, limit, offset int) ([]TrashedImage, int, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var total int
+	err := DB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM images WHERE owner_id = $1 AND deleted_at IS NOT NULL",
+		ownerID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.QueryContext(ctx,
+		`SELECT `+imageInfoColumns+`, i.deleted_at::text,
+		        (i.deleted_at + make_interval(secs => $4))::text
+		 FROM images i
+		 JOIN users u ON i.owner_id = u.id
+		 WHERE i.owner_id = $2 AND i.deleted_at IS NOT NULL
+		 ORDER BY i.deleted_at DESC, i.id
+		 LIMIT $1 OFFSET $3`,
+		limit, ownerID, offset, retention.Seconds(),
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var images []TrashedImage
+	for rows.Next() {
+		var img TrashedImage
+		if err := rows.Scan(append(img.fields(), &img.DeletedAt, &img.PurgeAt)...); err != nil {
+			return nil, 0, err
+		}
+		images = append(images, img)
+	}
+	return images, total, rows.Err()
+}
+
+// PurgeTrash permanently deletes up to limit trashed images and their
+// earlier versions in one transaction, freeing blobs nothing else
+// references, and returns how many images were deleted. ownerID "" purges
+// every user's trash; a nil before purges regardless of when images were
+// trashed.
+func PurgeTrash(ctx context.Context, ownerID string, before *time.Time, limit int) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Versions go first so their blob references are returned rather than
+	// removed by the cascade
+	rows, err := tx.QueryContext(ctx,
+		`WITH doomed AS (
+		     SELECT id FROM images
+		     WHERE deleted_at IS NOT NULL
+		       AND (NULLIF($1, '') IS NULL OR owner_id = NULLIF($1, '')::uuid)
+		       AND ($2::timestamptz IS NULL OR deleted_at < $2)
+		     ORDER BY deleted_at
+		     LIMIT $3
+		     FOR UPDATE SKIP LOCKED
+		 ), versions AS (
+		     DELETE FROM image_versions WHERE image_id IN (SELECT id FROM doomed)
+		     RETURNING blob_sha256
+		 )
+		 SELECT id::text, '' FROM doomed
+		 UNION ALL
+		 SELECT '', blob_sha256 FROM versions`,
+		ownerID, before, limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids, hashes []string
+	for rows.Next() {
+		var id, hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if id != "" {
+			ids = append(ids, id)
+		} else {
+			hashes = append(hashes, hash)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	rows, err = tx.QueryContext(ctx,
+		"DELETE FROM images WHERE id = ANY($1::uuid[]) RETURNING blob_sha256",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := releaseBlobs(ctx, tx, hashes); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// ImageVersion is one version of an image's content
+type ImageVersion struct {
+	Version     int
+	Filename    string
+	ContentType string
+	Size        int
+	Width       int
+	Height      int
+	CreatedAt   string // when this version became current
+	ReplacedAt  string // "" for the current version
+	Current     bool
+}
+
+// ReplaceImageContent makes data the image's current content, keeping its
+// ID, metadata, tags, albums and share links, and queues processing for the
+// new content. Edits made to the previous content are dropped. The previous
+// content is kept as a version. It returns the new version number, or 0 if
+// the image doesn't exist or is trashed (owner must be verified by caller).
+// The new content counts against the owner's storage quota as well as the
+// kept version; ErrStorageQuotaExceeded is returned if it doesn't fit.
+func ReplaceImageContent(ctx context.Context, imageID, filename, contentType string, data, jobPayload []byte) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if ok, err := reserveImageQuota(ctx, tx, imageID, int64(len(data))); err != nil || !ok {
+		return 0, err
+	}
+	hash, err := acquireBlob(ctx, tx, data)
+	if err != nil {
+		return 0, err
+	}
+	version, err := setImageContent(ctx, tx, imageID, hash, hash, filename, contentType, jobPayload)
+	if err != nil || version == 0 {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// RestoreImageVersion makes an earlier version the image's current content
+// again, as a new version, so the content it replaces is kept too. It
+// returns the new version number, or 0 if the image or version doesn't
+// exist or the image is trashed (owner must be verified by caller). Like a
+// replacement it counts against the owner's storage quota.
+func RestoreImageVersion(ctx context.Context, imageID string, version int, jobPayload []byte) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var hash, uploadHash, filename, contentType string
+	var size int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT v.blob_sha256, v.upload_sha256, v.filename, v.content_type, b.size
+		 FROM image_versions v JOIN blobs b ON v.blob_sha256 = b.sha256
+		 WHERE v.image_id = $1 AND v.version = $2`,
+		imageID, version,
+	).Scan(&hash, &uploadHash, &filename, &contentType, &size)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ok, err := reserveImageQuota(ctx, tx, imageID, size); err != nil || !ok {
+		return 0, err
+	}
+
+	// The version row keeps its reference; the image takes a new one
+	if err := retainBlob(ctx, tx, hash); err != nil {
+		return 0, err
+	}
+	newVersion, err := setImageContent(ctx, tx, imageID, hash, uploadHash, filename, contentType, jobPayload)
+	if err != nil || newVersion == 0 {
+		return 0, err
+	}
+	return newVersion, tx.Commit()
+}
+
+// reserveImageQuota reserves addBytes against the quota of the image's
+// owner (see reserveQuota), returning false if the image doesn't exist or
+// is trashed. It must run inside the caller's transaction.
+func reserveImageQuota(ctx context.Context, tx *sql.Tx, imageID string, addBytes int64) (bool, error) {
+	var ownerID string
+	err := tx.QueryRowContext(ctx,
+		"SELECT owner_id FROM images WHERE id = $1 AND deleted_at IS NULL",
+		imageID,
+	).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, reserveQuota(ctx, tx, ownerID, addBytes, 0)
+}
+
+// setImageContent moves the image's current content into image_versions
+// and installs the blob the caller has taken a reference to, returning the
+// new version number or 0 if the image doesn't exist or is trashed. The
+// previous content's blob reference passes to its version row. It must run
+// inside the caller's transaction.
+func setImageContent(ctx context.Context, tx *sql.Tx, imageID, hash, uploadHash, filename, contentType string, jobPayload []byte) (int, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT true FROM images WHERE id = $1 AND deleted_at IS NULL FOR UPDATE",
+		imageID,
+	).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO image_versions (image_id, version, blob_sha256, upload_sha256, filename, content_type, width, height, created_at)
+		 SELECT id, content_version, blob_sha256, upload_sha256, filename, content_type, width, height, content_updated_at
+		 FROM images WHERE id = $1`,
+		imageID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx,
+		`UPDATE images SET blob_sha256 = $1, upload_sha256 = $2, filename = $3, content_type = $4,
+		        width = NULL, height = NULL, phash = NULL, edits = NULL,
+		        blurhash = NULL, lqip = NULL, palette = NULL, dominant_color = NULL,
+		        processing_status = 'pending', processing_error = NULL,
+		        content_version = content_version + 1, content_updated_at = NOW(), updated_at = NOW()
+		 WHERE id = $5
+		 RETURNING content_version`,
+		hash, uploadHash, filename, contentType, imageID,
+	).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if err := enqueueJob(ctx, tx, JobProcessImage, imageID, jobPayload); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// ListImageVersions returns every version of an image's content, newest
+// (the current one) first, or nil if the image doesn't exist or is trashed
+func ListImageVersions(ctx context.Context, imageID string) ([]ImageVersion, error) {
+	rows, err := DB.QueryContext(ctx,
+		`SELECT i.content_version, i.filename, i.content_type, b.size, COALESCE(i.width, 0), COALESCE(i.height, 0),
+		        i.content_updated_at::text, '', true
+		 FROM images i JOIN blobs b ON i.blob_sha256 = b.sha256
+		 WHERE i.id = $1 AND i.deleted_at IS NULL
+		 UNION ALL
+		 SELECT v.version, v.filename, v.content_type, b.size, COALESCE(v.width, 0), COALESCE(v.height, 0),
+		        v.created_at::text, v.replaced_at::text, false
+		 FROM image_versions v
+		 JOIN images i ON v.image_id = i.id
+		 JOIN blobs b ON v.blob_sha256 = b.sha256
+		 WHERE v.image_id = $1 AND i.deleted_at IS NULL
+		 ORDER BY 1 DESC`,
+		imageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []ImageVersion
+	for rows.Next() {
+		var v ImageVersion
+		if err := rows.Scan(&v.Version, &v.Filename, &v.ContentType, &v.Size, &v.Width, &v.Height,
+			&v.CreatedAt, &v.ReplacedAt, &v.Current); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// SetImageEdits replaces an image's edit recipe (nil clears it) and queues
+// processing so its thumbnail and dimensions reflect the edits, reporting
+// whether the image exists and isn't trashed (owner must be verified by
+// caller)
+func SetImageEdits(ctx context.Context, imageID string, edits, jobPayload []byte) (bool, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE images SET edits = $1::jsonb, processing_status = 'pending', processing_error = NULL, updated_at = NOW()
+		 WHERE id = $2 AND deleted_at IS NULL`,
+		nullBytes(edits), imageID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := enqueueJob(ctx, tx, JobProcessImage, imageID, jobPayload); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// nullBytes passes an empty byte slice as SQL NULL; a nil []byte would
+// otherwise be sent as an empty value (an invalid document for JSONB)
+func nullBytes(data []byte) any {
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Watermark is a user's or the site-wide watermark configuration
+type Watermark struct {
+	UserID    string // "" for the site-wide watermark
+	Text      string // exactly one of Text and Image is set
+	Image     []byte
+	Position  string
+	Opacity   float64
+	Scale     float64
+	Enabled   bool
+	UpdatedAt string
+}
+
+const watermarkColumns = `COALESCE(user_id::text, ''), COALESCE(text, ''), image, position, opacity, scale, enabled, updated_at::text`
+
+// scanWatermark scans a row selected with watermarkColumns
+func scanWatermark(row interface{ Scan(...any) error }, w *Watermark) error {
+	return row.Scan(&w.UserID, &w.Text, &w.Image, &w.Position, &w.Opacity, &w.Scale, &w.Enabled, &w.UpdatedAt)
+}
+
+// GetWatermark returns a user's watermark, or the site-wide one for
+// userID "", or nil if none is configured
+func GetWatermark(ctx context.Context, userID string) (*Watermark, error) {
+	var w Watermark
+	err := scanWatermark(DB.QueryRowContext(ctx,
+		`SELECT `+watermarkColumns+` FROM watermarks WHERE user_id IS NOT DISTINCT FROM NULLIF($1, '')::uuid`,
+		userID,
+	), &w)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// EffectiveWatermark returns the watermark for images owned by ownerID:
+// their own configuration if they have one, otherwise the site-wide one.
+// It returns nil if that watermark is missing or disabled.
+func EffectiveWatermark(ctx context.Context, ownerID string) (*Watermark, error) {
+	var w Watermark
+	err := scanWatermark(DB.QueryRowContext(ctx,
+		`SELECT `+watermarkColumns+` FROM watermarks
+		 WHERE user_id = $1 OR user_id IS NULL
+		 ORDER BY user_id NULLS LAST
+		 LIMIT 1`,
+		ownerID,
+	), &w)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !w.Enabled {
+		return nil, nil
+	}
+	return &w, nil
+}
+
+// SetWatermark creates or replaces the watermark of w.UserID ("" for the
+// site-wide one)
+func SetWatermark(ctx context.Context, w *Watermark) error {
+	_, err := DB.ExecContext(ctx,
+		`INSERT INTO watermarks (user_id, text, image, position, opacity, scale, enabled)
+		 VALUES (NULLIF($1, '')::uuid, NULLIF($2, ''), $3, $4, $5, $6, $7)
+		 ON CONFLICT (user_id) DO UPDATE SET
+		     text = EXCLUDED.text, image = EXCLUDED.image, position = EXCLUDED.position,
+		     opacity = EXCLUDED.opacity, scale = EXCLUDED.scale, enabled = EXCLUDED.enabled,
+		     updated_at = NOW()`,
+		w.UserID, w.Text, nullBytes(w.Image), w.Position, w.Opacity, w.Scale, w.Enabled,
+	)
+	return err
+}
+
+// DeleteWatermark removes a user's watermark, or the site-wide one for
+// userID "", reporting whether it existed
+func DeleteWatermark(ctx context.Context, userID string) (bool, error) {
+	res, err := DB.ExecContext(ctx,
+		"DELETE FROM watermarks WHERE user_id IS NOT DISTINCT FROM NULLIF($1, '')::uuid",
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"connectrpc.com/connect"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	"github.com/mzzz-zzm/galleryblue/internal/jobs"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// AdminServer implements the AdminService
+type AdminServer struct{}
+
+// requireAdmin returns a connect error unless userID belongs to an administrator
+func requireAdmin(ctx context.Context, userID string) error {
+	if userID == "" {
+		return connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	user, err := db.GetUserByID(ctx, userID)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if user == nil || user.Role != db.RoleAdmin {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("admin access required"))
+	}
+	return nil
+}
+
+// processingStatusToDB converts an API processing state to its database value
+func processingStatusToDB(status usersv1.ProcessingStatus) string {
+	switch status {
+	case usersv1.ProcessingStatus_PROCESSING_STATUS_PENDING:
+		return db.ProcessingPending
+	case usersv1.ProcessingStatus_PROCESSING_STATUS_PROCESSING:
+		return db.ProcessingInProgress
+	case usersv1.ProcessingStatus_PROCESSING_STATUS_READY:
+		return db.ProcessingReady
+	case usersv1.ProcessingStatus_PROCESSING_STATUS_FAILED:
+		return db.ProcessingFailed
+	}
+	return ""
+}
+
+// parseOptionalTime parses an RFC 3339 timestamp, returning nil for ""
+func parseOptionalTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RegenerateDerivatives queues derivative regeneration for existing images
+// in batches, streaming progress after each batch (admin only)
+func (s *AdminServer) RegenerateDerivatives(
+	ctx context.Context,
+	req *connect.Request[usersv1.RegenerateDerivativesRequest],
+	stream *connect.ServerStream[usersv1.RegenerateDerivativesProgress],
+) error {
+	if err := requireAdmin(ctx, req.Header().Get("X-User-ID")); err != nil {
+		return err
+	}
+
+	if req.Msg.OwnerId != "" && !db.ValidUUID(req.Msg.OwnerId) {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("invalid owner id"))
+	}
+	if req.Msg.ResumeAfter != "" && !db.ValidUUID(req.Msg.ResumeAfter) {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("invalid resume_after"))
+	}
+
+	filter := db.RegenerateFilter{
+		OwnerID:          req.Msg.OwnerId,
+		ProcessingStatus: processingStatusToDB(req.Msg.ProcessingStatus),
+		After:            req.Msg.ResumeAfter,
+	}
+	if !req.Msg.IncludeCurrent {
+		filter.StaleSpec = jobs.ThumbnailSpec
+	}
+	var err error
+	if filter.CreatedAfter, err = parseOptionalTime(req.Msg.CreatedAfter); err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid created_after: %w", err))
+	}
+	if filter.CreatedBefore, err = parseOptionalTime(req.Msg.CreatedBefore); err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid created_before: %w", err))
+	}
+
+	_, err = jobs.Regenerate(ctx, jobs.RegenerateOptions{
+		Filter:    filter,
+		BatchSize: int(req.Msg.BatchSize),
+		DryRun:    req.Msg.DryRun,
+	}, func(p jobs.RegenerateProgress) error {
+		return stream.Send(&usersv1.RegenerateDerivativesProgress{
+			Total:  int32(p.Total),
+			Queued: int32(p.Done),
+			Cursor: p.Cursor,
+		})
+	})
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, fmt.Errorf("regeneration stopped: %w", err))
+	}
+	return nil
+}
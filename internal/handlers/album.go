@@ -0,0 +1,551 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"connectrpc.com/connect"
+
+	"github.com/mzzz-zzm/galleryblue/internal/authz"
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// maxAlbumBatch caps the number of images in a single album request
+const maxAlbumBatch = 500
+
+// AlbumServer implements the AlbumService
+type AlbumServer struct{}
+
+// albumToProto converts a database album to its API form. role is the
+// current user's role on it.
+func albumToProto(a *db.Album, role authz.Role) *usersv1.Album {
+	return &usersv1.Album{
+		Id:               a.ID,
+		OwnerId:          a.OwnerID,
+		OwnerDisplayName: a.OwnerDisplayName,
+		Title:            a.Title,
+		Description:      a.Description,
+		CoverImageId:     a.CoverImageID,
+		CoverThumbnail:   a.CoverThumbnail,
+		ImageCount:       int32(a.ImageCount),
+		CreatedAt:        a.CreatedAt,
+		UpdatedAt:        a.UpdatedAt,
+		MyRole:           albumRoleToProto(role),
+	}
+}
+
+// loadAlbum fetches an album the caller has already been authorized for
+func loadAlbum(ctx context.Context, albumID string) (*db.Album, error) {
+	album, err := db.GetAlbum(ctx, albumID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if album == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("album not found"))
+	}
+	return album, nil
+}
+
+// checkImageBatch validates a list of image IDs from a request
+func checkImageBatch(imageIDs []string) error {
+	if len(imageIDs) > maxAlbumBatch {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("at most %d images per request", maxAlbumBatch))
+	}
+	for _, id := range imageIDs {
+		if id == "" {
+			return connect.NewError(connect.CodeInvalidArgument, errors.New("image id is required"))
+		}
+	}
+	return nil
+}
+
+// checkOwnImages returns a connect error unless every image exists and
+// belongs to userID
+func checkOwnImages(ctx context.Context, imageIDs []string, userID string) error {
+	if len(imageIDs) == 0 {
+		return nil
+	}
+	owners, err := db.GetImageOwners(ctx, imageIDs)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	for _, id := range imageIDs {
+		ownerID, ok := owners[id]
+		if !ok {
+			return connect.NewError(connect.CodeNotFound, fmt.Errorf("image %s not found", id))
+		}
+		if ownerID != userID {
+			return connect.NewError(connect.CodePermissionDenied, fmt.Errorf("image %s is not yours", id))
+		}
+	}
+	return nil
+}
+
+// CreateAlbum creates an album owned by the current user
+func (s *AlbumServer) CreateAlbum(
+	ctx context.Context,
+	req *connect.Request[usersv1.CreateAlbumRequest],
+) (*connect.Response[usersv1.CreateAlbumResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	if req.Msg.Title == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("title is required"))
+	}
+	if err := checkImageBatch(req.Msg.ImageIds); err != nil {
+		return nil, err
+	}
+	if err := checkOwnImages(ctx, req.Msg.ImageIds, userID); err != nil {
+		return nil, err
+	}
+
+	albumID, err := db.CreateAlbum(ctx, userID, req.Msg.Title, req.Msg.Description, req.Msg.ImageIds)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to create album: %w", err))
+	}
+
+	album, err := loadAlbum(ctx, albumID)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&usersv1.CreateAlbumResponse{
+		Album: albumToProto(album, authz.RoleOwner),
+	}), nil
+}
+
+// GetAlbum returns an album and a page of its images (owner and members)
+func (s *AlbumServer) GetAlbum(
+	ctx context.Context,
+	req *connect.Request[usersv1.GetAlbumRequest],
+) (*connect.Response[usersv1.GetAlbumResponse], error) {
+	role, err := authorizeAlbum(ctx, req.Header().Get("X-User-ID"), req.Msg.Id, authz.AlbumView)
+	if err != nil {
+		return nil, err
+	}
+	album, err := loadAlbum(ctx, req.Msg.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	images, total, err := db.ListAlbumImages(ctx, album.ID, int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	watermarks := newThumbnailWatermarks(req.Header().Get("X-User-ID"))
+	var pbImages []*usersv1.ImageInfo
+	for _, img := range images {
+		if err := watermarks.apply(ctx, &img); err != nil {
+			return nil, err
+		}
+		pbImages = append(pbImages, imageInfoToProto(img))
+	}
+
+	return connect.NewResponse(&usersv1.GetAlbumResponse{
+		Album:  albumToProto(album, role),
+		Images: pbImages,
+		Total:  int32(total),
+	}), nil
+}
+
+// ListAlbums returns albums owned by or shared with the current user
+func (s *AlbumServer) ListAlbums(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListAlbumsRequest],
+) (*connect.Response[usersv1.ListAlbumsResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	albums, total, err := db.ListAlbumsForUser(ctx, userID, int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	var pbAlbums []*usersv1.Album
+	for i := range albums {
+		role := authz.MemberRole(albums[i].MemberRole)
+		if albums[i].OwnerID == userID {
+			role = authz.RoleOwner
+		}
+		pbAlbums = append(pbAlbums, albumToProto(&albums[i], role))
+	}
+
+	return connect.NewResponse(&usersv1.ListAlbumsResponse{
+		Albums: pbAlbums,
+		Total:  int32(total),
+	}), nil
+}
+
+// UpdateAlbum updates album details (owner) and the cover image (editors)
+func (s *AlbumServer) UpdateAlbum(
+	ctx context.Context,
+	req *connect.Request[usersv1.UpdateAlbumRequest],
+) (*connect.Response[usersv1.UpdateAlbumResponse], error) {
+	action := authz.AlbumArrange
+	if req.Msg.Title != nil || req.Msg.Description != nil {
+		action = authz.AlbumEdit
+	}
+	role, err := authorizeAlbum(ctx, req.Header().Get("X-User-ID"), req.Msg.Id, action)
+	if err != nil {
+		return nil, err
+	}
+	album, err := loadAlbum(ctx, req.Msg.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Msg.Title != nil {
+		if *req.Msg.Title == "" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("title cannot be empty"))
+		}
+		album.Title = *req.Msg.Title
+	}
+	if req.Msg.Description != nil {
+		album.Description = *req.Msg.Description
+	}
+	if req.Msg.CoverImageId != nil {
+		if cover := *req.Msg.CoverImageId; cover != "" {
+			inAlbum, err := db.AlbumHasImage(ctx, album.ID, cover)
+			if err != nil {
+				return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+			}
+			if !inAlbum {
+				return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("cover image must be in the album"))
+			}
+		}
+		album.CoverImageID = *req.Msg.CoverImageId
+	}
+
+	if err := db.UpdateAlbum(ctx, album.ID, album.Title, album.Description, album.CoverImageID); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to update album: %w", err))
+	}
+
+	updated, err := loadAlbum(ctx, album.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&usersv1.UpdateAlbumResponse{
+		Album: albumToProto(updated, role),
+	}), nil
+}
+
+// DeleteAlbum removes an album but not its images (owner only)
+func (s *AlbumServer) DeleteAlbum(
+	ctx context.Context,
+	req *connect.Request[usersv1.DeleteAlbumRequest],
+) (*connect.Response[usersv1.DeleteAlbumResponse], error) {
+	if _, err := authorizeAlbum(ctx, req.Header().Get("X-User-ID"), req.Msg.Id, authz.AlbumDelete); err != nil {
+		return nil, err
+	}
+
+	if err := db.DeleteAlbum(ctx, req.Msg.Id); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to delete album: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.DeleteAlbumResponse{
+		Success: true,
+	}), nil
+}
+
+// AddAlbumImages appends the current user's images to an album (contributors)
+func (s *AlbumServer) AddAlbumImages(
+	ctx context.Context,
+	req *connect.Request[usersv1.AddAlbumImagesRequest],
+) (*connect.Response[usersv1.AddAlbumImagesResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if _, err := authorizeAlbum(ctx, userID, req.Msg.AlbumId, authz.AlbumAddImages); err != nil {
+		return nil, err
+	}
+
+	if len(req.Msg.ImageIds) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image ids are required"))
+	}
+	if err := checkImageBatch(req.Msg.ImageIds); err != nil {
+		return nil, err
+	}
+	if err := checkOwnImages(ctx, req.Msg.ImageIds, userID); err != nil {
+		return nil, err
+	}
+
+	added, err := db.AddAlbumImages(ctx, req.Msg.AlbumId, userID, req.Msg.ImageIds)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to add images: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.AddAlbumImagesResponse{
+		Added: int32(added),
+	}), nil
+}
+
+// RemoveAlbumImages removes images from an album. Editors can remove any
+// image; contributors only the images they added.
+func (s *AlbumServer) RemoveAlbumImages(
+	ctx context.Context,
+	req *connect.Request[usersv1.RemoveAlbumImagesRequest],
+) (*connect.Response[usersv1.RemoveAlbumImagesResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	role, err := authorizeAlbum(ctx, userID, req.Msg.AlbumId, authz.AlbumRemoveOwnImages)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Msg.ImageIds) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image ids are required"))
+	}
+	if err := checkImageBatch(req.Msg.ImageIds); err != nil {
+		return nil, err
+	}
+
+	addedBy := userID
+	if role.Can(authz.AlbumArrange) {
+		addedBy = ""
+	}
+	removed, err := db.RemoveAlbumImages(ctx, req.Msg.AlbumId, req.Msg.ImageIds, addedBy)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to remove images: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.RemoveAlbumImagesResponse{
+		Removed: int32(removed),
+	}), nil
+}
+
+// ReorderAlbumImages moves images within an album (editors)
+func (s *AlbumServer) ReorderAlbumImages(
+	ctx context.Context,
+	req *connect.Request[usersv1.ReorderAlbumImagesRequest],
+) (*connect.Response[usersv1.ReorderAlbumImagesResponse], error) {
+	if _, err := authorizeAlbum(ctx, req.Header().Get("X-User-ID"), req.Msg.AlbumId, authz.AlbumArrange); err != nil {
+		return nil, err
+	}
+
+	if len(req.Msg.ImageIds) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image ids are required"))
+	}
+	if err := checkImageBatch(req.Msg.ImageIds); err != nil {
+		return nil, err
+	}
+
+	ok, err := db.ReorderAlbumImages(ctx, req.Msg.AlbumId, req.Msg.ImageIds, req.Msg.AfterImageId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to reorder images: %w", err))
+	}
+	if !ok {
+		return nil, connect.NewError(connect.CodeInvalidArgument,
+			errors.New("images must each be listed once, be in the album and not include the anchor image"))
+	}
+
+	return connect.NewResponse(&usersv1.ReorderAlbumImagesResponse{
+		Success: true,
+	}), nil
+}
+
+// memberRoleToDB converts an API role to a member role. Only viewer,
+// contributor and editor can be granted.
+func memberRoleToDB(role usersv1.AlbumRole) (string, bool) {
+	switch role {
+	case usersv1.AlbumRole_ALBUM_ROLE_VIEWER:
+		return db.AlbumRoleViewer, true
+	case usersv1.AlbumRole_ALBUM_ROLE_CONTRIBUTOR:
+		return db.AlbumRoleContributor, true
+	case usersv1.AlbumRole_ALBUM_ROLE_EDITOR:
+		return db.AlbumRoleEditor, true
+	}
+	return "", false
+}
+
+// albumMemberToProto converts a database album member to its API form
+func albumMemberToProto(m *db.AlbumMember) *usersv1.AlbumMember {
+	return &usersv1.AlbumMember{
+		UserId:      m.UserID,
+		Email:       m.Email,
+		DisplayName: m.DisplayName,
+		Role:        albumRoleToProto(authz.MemberRole(m.Role)),
+		Pending:     m.Status == db.MemberInvited,
+		InvitedBy:   m.InvitedBy,
+		CreatedAt:   m.CreatedAt,
+	}
+}
+
+// InviteAlbumMember invites a user by email, or changes an existing
+// member's role (owner only)
+func (s *AlbumServer) InviteAlbumMember(
+	ctx context.Context,
+	req *connect.Request[usersv1.InviteAlbumMemberRequest],
+) (*connect.Response[usersv1.InviteAlbumMemberResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if _, err := authorizeAlbum(ctx, userID, req.Msg.AlbumId, authz.AlbumManageMembers); err != nil {
+		return nil, err
+	}
+
+	role, ok := memberRoleToDB(req.Msg.Role)
+	if !ok {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("role must be viewer, contributor or editor"))
+	}
+	if req.Msg.Email == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("email is required"))
+	}
+
+	invitee, err := db.GetUserByEmail(ctx, req.Msg.Email)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if invitee == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+	}
+	if invitee.ID == userID {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("you already own this album"))
+	}
+
+	if err := db.InviteAlbumMember(ctx, req.Msg.AlbumId, invitee.ID, role, userID); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to invite member: %w", err))
+	}
+
+	member, err := db.GetAlbumMember(ctx, req.Msg.AlbumId, invitee.ID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if member == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("album not found"))
+	}
+
+	return connect.NewResponse(&usersv1.InviteAlbumMemberResponse{
+		Member: albumMemberToProto(member),
+	}), nil
+}
+
+// ListAlbumMembers returns an album's members and pending invitations
+// (owner and members)
+func (s *AlbumServer) ListAlbumMembers(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListAlbumMembersRequest],
+) (*connect.Response[usersv1.ListAlbumMembersResponse], error) {
+	if _, err := authorizeAlbum(ctx, req.Header().Get("X-User-ID"), req.Msg.AlbumId, authz.AlbumView); err != nil {
+		return nil, err
+	}
+
+	members, err := db.ListAlbumMembers(ctx, req.Msg.AlbumId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	var pbMembers []*usersv1.AlbumMember
+	for i := range members {
+		pbMembers = append(pbMembers, albumMemberToProto(&members[i]))
+	}
+
+	return connect.NewResponse(&usersv1.ListAlbumMembersResponse{
+		Members: pbMembers,
+	}), nil
+}
+
+// RemoveAlbumMember removes a member or withdraws an invitation (owner).
+// Users can also remove themselves to leave an album or decline an
+// invitation.
+func (s *AlbumServer) RemoveAlbumMember(
+	ctx context.Context,
+	req *connect.Request[usersv1.RemoveAlbumMemberRequest],
+) (*connect.Response[usersv1.RemoveAlbumMemberResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if req.Msg.AlbumId == "" || req.Msg.UserId == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("album id and user id are required"))
+	}
+
+	// Invitees aren't members yet, so leaving needs no album permission
+	if req.Msg.UserId != userID {
+		if _, err := authorizeAlbum(ctx, userID, req.Msg.AlbumId, authz.AlbumManageMembers); err != nil {
+			return nil, err
+		}
+	}
+
+	removed, err := db.RemoveAlbumMember(ctx, req.Msg.AlbumId, req.Msg.UserId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to remove member: %w", err))
+	}
+	if !removed {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("member not found"))
+	}
+
+	return connect.NewResponse(&usersv1.RemoveAlbumMemberResponse{
+		Success: true,
+	}), nil
+}
+
+// ListAlbumInvitations returns the current user's pending invitations
+func (s *AlbumServer) ListAlbumInvitations(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListAlbumInvitationsRequest],
+) (*connect.Response[usersv1.ListAlbumInvitationsResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	invitations, err := db.ListAlbumInvitations(ctx, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	var pbInvitations []*usersv1.AlbumInvitation
+	for _, inv := range invitations {
+		pbInvitations = append(pbInvitations, &usersv1.AlbumInvitation{
+			AlbumId:       inv.AlbumID,
+			AlbumTitle:    inv.AlbumTitle,
+			Role:          albumRoleToProto(authz.MemberRole(inv.Role)),
+			InvitedBy:     inv.InvitedByID,
+			InvitedByName: inv.InvitedByName,
+			CreatedAt:     inv.CreatedAt,
+		})
+	}
+
+	return connect.NewResponse(&usersv1.ListAlbumInvitationsResponse{
+		Invitations: pbInvitations,
+	}), nil
+}
+
+// AcceptAlbumInvitation makes the current user an active member of an album
+// they were invited to
+func (s *AlbumServer) AcceptAlbumInvitation(
+	ctx context.Context,
+	req *connect.Request[usersv1.AcceptAlbumInvitationRequest],
+) (*connect.Response[usersv1.AcceptAlbumInvitationResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if req.Msg.AlbumId == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("album id is required"))
+	}
+
+	accepted, err := db.AcceptAlbumInvitation(ctx, req.Msg.AlbumId, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to accept invitation: %w", err))
+	}
+	if !accepted {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("invitation not found"))
+	}
+
+	role, err := authorizeAlbum(ctx, userID, req.Msg.AlbumId, authz.AlbumView)
+	if err != nil {
+		return nil, err
+	}
+	album, err := loadAlbum(ctx, req.Msg.AlbumId)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&usersv1.AcceptAlbumInvitationResponse{
+		Album: albumToProto(album, role),
+	}), nil
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"connectrpc.com/connect"
+
+	"github.com/mzzz-zzm/galleryblue/internal/authz"
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// authorizeImage returns a connect error unless userID may perform action
+// on the image. denied is the message reported when permission is refused.
+// Only authz.ImageView may be checked for anonymous users.
+func authorizeImage(ctx context.Context, userID, imageID string, action authz.Action, denied string) error {
+	if userID == "" && action != authz.ImageView {
+		return connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if imageID == "" {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("image id is required"))
+	}
+	switch err := authz.Image(ctx, userID, imageID, action); {
+	case err == nil:
+		return nil
+	case errors.Is(err, authz.ErrNotFound):
+		return connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	case errors.Is(err, authz.ErrForbidden):
+		return connect.NewError(connect.CodePermissionDenied, errors.New(denied))
+	default:
+		return connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+}
+
+// maxImageBatch caps the number of images in a batch request
+const maxImageBatch = 500
+
+// authorizeImageBatch checks action on a batch of images with one query.
+// It returns the request's image IDs without duplicates, the subset userID
+// may act on, and the reason each other image was refused. Malformed IDs
+// are refused as not found without reaching the database.
+func authorizeImageBatch(ctx context.Context, userID string, imageIDs []string, action authz.Action, denied string) (ids, allowed []string, refused map[string]string, err error) {
+	if userID == "" {
+		return nil, nil, nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if len(imageIDs) == 0 {
+		return nil, nil, nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image ids are required"))
+	}
+	if len(imageIDs) > maxImageBatch {
+		return nil, nil, nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("at most %d images per request", maxImageBatch))
+	}
+	seen := make(map[string]bool, len(imageIDs))
+	refused = make(map[string]string)
+	var valid []string
+	for _, id := range imageIDs {
+		if id == "" {
+			return nil, nil, nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image id is required"))
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+		if db.ValidUUID(id) {
+			valid = append(valid, id)
+		} else {
+			refused[id] = "image not found"
+		}
+	}
+
+	results, err := authz.Images(ctx, userID, valid, action)
+	if err != nil {
+		return nil, nil, nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	for _, id := range valid {
+		switch err := results[id]; {
+		case err == nil:
+			allowed = append(allowed, id)
+		case errors.Is(err, authz.ErrNotFound):
+			refused[id] = "image not found"
+		default:
+			refused[id] = denied
+		}
+	}
+	return ids, allowed, refused, nil
+}
+
+// authorizeAlbum returns userID's role on the album, or a connect error
+// unless they may perform action on it
+func authorizeAlbum(ctx context.Context, userID, albumID string, action authz.Action) (authz.Role, error) {
+	if userID == "" {
+		return authz.RoleNone, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if albumID == "" {
+		return authz.RoleNone, connect.NewError(connect.CodeInvalidArgument, errors.New("album id is required"))
+	}
+	role, err := authz.Album(ctx, userID, albumID, action)
+	switch {
+	case err == nil:
+		return role, nil
+	case errors.Is(err, authz.ErrNotFound):
+		return role, connect.NewError(connect.CodeNotFound, errors.New("album not found"))
+	case errors.Is(err, authz.ErrForbidden):
+		return role, connect.NewError(connect.CodePermissionDenied, errors.New("your album role does not allow this"))
+	default:
+		return role, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+}
+
+// albumRoleToProto converts an album role to the API enum
+func albumRoleToProto(role authz.Role) usersv1.AlbumRole {
+	switch role {
+	case authz.RoleViewer:
+		return usersv1.AlbumRole_ALBUM_ROLE_VIEWER
+	case authz.RoleContributor:
+		return usersv1.AlbumRole_ALBUM_ROLE_CONTRIBUTOR
+	case authz.RoleEditor:
+		return usersv1.AlbumRole_ALBUM_ROLE_EDITOR
+	case authz.RoleOwner:
+		return usersv1.AlbumRole_ALBUM_ROLE_OWNER
+	}
+	return usersv1.AlbumRole_ALBUM_ROLE_UNSPECIFIED
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a size-bounded, least-recently-used cache safe for
+// concurrent use. Each entry has a cost (usually its size in bytes) and
+// the oldest entries are evicted once the total exceeds maxCost.
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	maxCost int
+	cost    int
+	order   *list.List // front is most recently used
+	items   map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+	cost  int
+}
+
+// newLRUCache creates a cache holding entries up to a total of maxCost
+func newLRUCache[V any](maxCost int) *lruCache[V] {
+	return &lruCache[V]{
+		maxCost: maxCost,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value cached under key, if any
+func (c *lruCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry[V]).value, true
+}
+
+// Add caches value under key, replacing any previous value. Values
+// costing more than the whole cache are not kept.
+func (c *lruCache[V]) Add(key string, value V, cost int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if cost > c.maxCost {
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, cost: cost})
+	c.cost += cost
+	for c.cost > c.maxCost {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry; c.mu must be held
+func (c *lruCache[V]) remove(el *list.Element) {
+	e := c.order.Remove(el).(*lruEntry[V])
+	delete(c.items, e.key)
+	c.cost -= e.cost
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"connectrpc.com/connect"
+
+	"github.com/mzzz-zzm/galleryblue/internal/authz"
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	"github.com/mzzz-zzm/galleryblue/internal/markup"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// maxCommentLength caps comment bodies, in characters
+const maxCommentLength = 2000
+
+// commentThrottle limits how fast one user can post comments
+var commentThrottle = db.CommentThrottle{PerMinute: 5, PerHour: 60}
+
+// CommentServer implements the CommentService
+type CommentServer struct{}
+
+// commentToProto converts a database comment to its API form, hiding the
+// author of deleted comments
+func commentToProto(c *db.Comment) *usersv1.Comment {
+	pb := &usersv1.Comment{
+		Id:         c.ID,
+		ImageId:    c.ImageID,
+		ParentId:   c.ParentID,
+		CreatedAt:  c.CreatedAt,
+		EditedAt:   c.EditedAt,
+		Deleted:    c.Deleted,
+		ReplyCount: int32(c.ReplyCount),
+	}
+	if !c.Deleted {
+		pb.AuthorId = c.AuthorID
+		pb.AuthorDisplayName = c.AuthorDisplayName
+		pb.Body = c.Body
+		pb.BodyHtml = markup.Render(c.Body)
+	}
+	return pb
+}
+
+// commentBody cleans and validates a comment body
+func commentBody(body string) (string, error) {
+	body = markup.Clean(body)
+	if body == "" {
+		return "", connect.NewError(connect.CodeInvalidArgument, errors.New("comment cannot be empty"))
+	}
+	if utf8.RuneCountInString(body) > maxCommentLength {
+		return "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("comment must be at most %d characters", maxCommentLength))
+	}
+	return body, nil
+}
+
+// loadComment fetches a comment, checking that userID can still view its
+// image
+func loadComment(ctx context.Context, userID, commentID string) (*db.Comment, error) {
+	if commentID == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("comment id is required"))
+	}
+	c, err := db.GetComment(ctx, commentID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if c == nil || c.Deleted {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("comment not found"))
+	}
+	if err := authorizeImage(ctx, userID, c.ImageID, authz.ImageView, "image not found"); err != nil {
+		if connect.CodeOf(err) == connect.CodeNotFound {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("comment not found"))
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// commentsDisabledError reports that an image's owner has turned comments off
+func commentsDisabledError() error {
+	return connect.NewError(connect.CodeFailedPrecondition, errors.New("comments are disabled on this image"))
+}
+
+// CreateComment adds a comment or reply to an image the caller can view
+func (s *CommentServer) CreateComment(
+	ctx context.Context,
+	req *connect.Request[usersv1.CreateCommentRequest],
+) (*connect.Response[usersv1.CreateCommentResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if err := authorizeImage(ctx, userID, req.Msg.ImageId, authz.ImageView, "image not found"); err != nil {
+		return nil, err
+	}
+	body, err := commentBody(req.Msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := db.CreateComment(ctx, req.Msg.ImageId, req.Msg.ParentId, userID, body, commentThrottle)
+	switch {
+	case errors.Is(err, db.ErrCommentsDisabled):
+		return nil, commentsDisabledError()
+	case errors.Is(err, db.ErrCommentThrottled):
+		return nil, connect.NewError(connect.CodeResourceExhausted, errors.New("you are commenting too quickly; try again later"))
+	case errors.Is(err, db.ErrDuplicateComment):
+		return nil, connect.NewError(connect.CodeAlreadyExists, errors.New("you already posted this comment"))
+	case err != nil:
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to create comment: %w", err))
+	case c == nil && req.Msg.ParentId != "":
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("comment not found"))
+	case c == nil:
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	}
+
+	return connect.NewResponse(&usersv1.CreateCommentResponse{
+		Comment: commentToProto(c),
+	}), nil
+}
+
+// EditComment replaces the body of one of the caller's comments
+func (s *CommentServer) EditComment(
+	ctx context.Context,
+	req *connect.Request[usersv1.EditCommentRequest],
+) (*connect.Response[usersv1.EditCommentResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	c, err := loadComment(ctx, userID, req.Msg.Id)
+	if err != nil {
+		return nil, err
+	}
+	if c.AuthorID != userID {
+		return nil, connect.NewError(connect.CodePermissionDenied, errors.New("you can only edit your own comments"))
+	}
+	body, err := commentBody(req.Msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	disabled, err := db.CommentsDisabled(ctx, c.ImageID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if disabled {
+		return nil, commentsDisabledError()
+	}
+
+	edited, err := db.EditComment(ctx, c.ID, userID, body)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to edit comment: %w", err))
+	}
+	if !edited {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("comment not found"))
+	}
+	if c, err = db.GetComment(ctx, c.ID); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if c == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("comment not found"))
+	}
+
+	return connect.NewResponse(&usersv1.EditCommentResponse{
+		Comment: commentToProto(c),
+	}), nil
+}
+
+// DeleteComment deletes one of the caller's comments, or any comment on
+// the caller's images
+func (s *CommentServer) DeleteComment(
+	ctx context.Context,
+	req *connect.Request[usersv1.DeleteCommentRequest],
+) (*connect.Response[usersv1.DeleteCommentResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	c, err := loadComment(ctx, userID, req.Msg.Id)
+	if err != nil {
+		return nil, err
+	}
+	if c.AuthorID != userID {
+		if err := authorizeImage(ctx, userID, c.ImageID, authz.ImageModerate,
+			"you can only delete your own comments or comments on your images"); err != nil {
+			return nil, err
+		}
+	}
+
+	deleted, err := db.DeleteComment(ctx, c.ID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to delete comment: %w", err))
+	}
+	if !deleted {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("comment not found"))
+	}
+
+	return connect.NewResponse(&usersv1.DeleteCommentResponse{
+		Success: true,
+	}), nil
+}
+
+// ListComments returns a page of the comments on an image, or of the
+// replies to one of them
+func (s *CommentServer) ListComments(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListCommentsRequest],
+) (*connect.Response[usersv1.ListCommentsResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.ImageId, authz.ImageView, "image not found"); err != nil {
+		return nil, err
+	}
+
+	comments, total, err := db.ListComments(ctx, req.Msg.ImageId, req.Msg.ParentId, int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	disabled, err := db.CommentsDisabled(ctx, req.Msg.ImageId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	var pbComments []*usersv1.Comment
+	for i := range comments {
+		pbComments = append(pbComments, commentToProto(&comments[i]))
+	}
+
+	return connect.NewResponse(&usersv1.ListCommentsResponse{
+		Comments:        pbComments,
+		Total:           int32(total),
+		CommentsEnabled: !disabled,
+	}), nil
+}
+
+// SetCommentsEnabled allows or stops new comments on one of the caller's
+// images
+func (s *CommentServer) SetCommentsEnabled(
+	ctx context.Context,
+	req *connect.Request[usersv1.SetCommentsEnabledRequest],
+) (*connect.Response[usersv1.SetCommentsEnabledResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.ImageId, authz.ImageModerate, "you can only moderate comments on your own images"); err != nil {
+		return nil, err
+	}
+
+	if err := db.SetCommentsDisabled(ctx, req.Msg.ImageId, !req.Msg.Enabled); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.SetCommentsEnabledResponse{
+		Success: true,
+	}), nil
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"connectrpc.com/connect"
+
+	"github.com/mzzz-zzm/galleryblue/internal/authz"
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	"github.com/mzzz-zzm/galleryblue/internal/imaging"
+	"github.com/mzzz-zzm/galleryblue/internal/jobs"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// editOps maps API edit operations to their imaging names
+var editOps = map[usersv1.ImageEditOp]string{
+	usersv1.ImageEditOp_IMAGE_EDIT_OP_CROP:       imaging.EditCrop,
+	usersv1.ImageEditOp_IMAGE_EDIT_OP_ROTATE:     imaging.EditRotate,
+	usersv1.ImageEditOp_IMAGE_EDIT_OP_FLIP:       imaging.EditFlip,
+	usersv1.ImageEditOp_IMAGE_EDIT_OP_BRIGHTNESS: imaging.EditBrightness,
+	usersv1.ImageEditOp_IMAGE_EDIT_OP_CONTRAST:   imaging.EditContrast,
+	usersv1.ImageEditOp_IMAGE_EDIT_OP_SATURATION: imaging.EditSaturation,
+	usersv1.ImageEditOp_IMAGE_EDIT_OP_GRAYSCALE:  imaging.EditGrayscale,
+}
+
+// editsFromProto converts an API edit recipe, rejecting unknown operations
+func editsFromProto(pbEdits []*usersv1.ImageEdit) ([]imaging.Edit, error) {
+	edits := make([]imaging.Edit, 0, len(pbEdits))
+	for i, e := range pbEdits {
+		op, ok := editOps[e.Op]
+		if !ok {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("edit %d: invalid operation", i+1))
+		}
+		edits = append(edits, imaging.Edit{
+			Op:       op,
+			X:        int(e.X),
+			Y:        int(e.Y),
+			Width:    int(e.Width),
+			Height:   int(e.Height),
+			Degrees:  int(e.Degrees),
+			Vertical: e.Vertical,
+			Amount:   float64(e.Amount),
+		})
+	}
+	return edits, nil
+}
+
+// editsToProto converts an edit recipe to its API form
+func editsToProto(edits []imaging.Edit) []*usersv1.ImageEdit {
+	var pbEdits []*usersv1.ImageEdit
+	for _, e := range edits {
+		var op usersv1.ImageEditOp
+		for pbOp, name := range editOps {
+			if name == e.Op {
+				op = pbOp
+			}
+		}
+		pbEdits = append(pbEdits, &usersv1.ImageEdit{
+			Op:       op,
+			X:        int32(e.X),
+			Y:        int32(e.Y),
+			Width:    int32(e.Width),
+			Height:   int32(e.Height),
+			Degrees:  int32(e.Degrees),
+			Vertical: e.Vertical,
+			Amount:   float32(e.Amount),
+		})
+	}
+	return pbEdits
+}
+
+// decodeEdits parses a stored edit recipe
+func decodeEdits(data []byte) ([]imaging.Edit, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var edits []imaging.Edit
+	if err := json.Unmarshal(data, &edits); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("invalid edit recipe: %w", err))
+	}
+	return edits, nil
+}
+
+// setEdits stores an image's edit recipe (nil clears it) and queues its
+// thumbnail for regeneration
+func setEdits(ctx context.Context, imageID string, edits []imaging.Edit) error {
+	var recipe []byte
+	if len(edits) > 0 {
+		var err error
+		if recipe, err = json.Marshal(edits); err != nil {
+			return connect.NewError(connect.CodeInternal, fmt.Errorf("failed to encode edits: %w", err))
+		}
+	}
+	payload, err := json.Marshal(jobs.ProcessImagePayload{})
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, fmt.Errorf("failed to encode job: %w", err))
+	}
+
+	ok, err := db.SetImageEdits(ctx, imageID, recipe, payload)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, fmt.Errorf("failed to save edits: %w", err))
+	}
+	if !ok {
+		return connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	}
+	return nil
+}
+
+// ApplyEdits replaces the edit recipe of an image (owner only)
+func (s *ImageServer) ApplyEdits(
+	ctx context.Context,
+	req *connect.Request[usersv1.ApplyEditsRequest],
+) (*connect.Response[usersv1.ApplyEditsResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageEdit, "you can only edit your own images"); err != nil {
+		return nil, err
+	}
+	edits, err := editsFromProto(req.Msg.Edits)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := db.GetImageByID(ctx, req.Msg.Id)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if img == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	}
+
+	// Check crops against the upright original without decoding it
+	cfg, _, err := imaging.Validate(img.Data)
+	if err != nil {
+		return nil, imageProcessingError(err)
+	}
+	width, height := cfg.Width, cfg.Height
+	if imaging.Orientation(img.Data) >= 5 {
+		width, height = height, width
+	}
+	if width, height, err = imaging.EditedSize(width, height, edits); err != nil {
+		return nil, imageProcessingError(err)
+	}
+
+	if err := setEdits(ctx, img.ID, edits); err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&usersv1.ApplyEditsResponse{
+		Width:  int32(width),
+		Height: int32(height),
+	}), nil
+}
+
+// RevertEdits removes all edits from an image (owner only)
+func (s *ImageServer) RevertEdits(
+	ctx context.Context,
+	req *connect.Request[usersv1.RevertEditsRequest],
+) (*connect.Response[usersv1.RevertEditsResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageEdit, "you can only edit your own images"); err != nil {
+		return nil, err
+	}
+
+	if err := setEdits(ctx, req.Msg.Id, nil); err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&usersv1.RevertEditsResponse{
+		Success: true,
+	}), nil
+}
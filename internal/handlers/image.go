@@ -1,62 +1,197 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"image"
-	"image/jpeg"
+	"html"
+	"net"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"connectrpc.com/connect"
-	"golang.org/x/image/draw"
 
+	"github.com/mzzz-zzm/galleryblue/internal/authz"
 	"github.com/mzzz-zzm/galleryblue/internal/db"
+	"github.com/mzzz-zzm/galleryblue/internal/imaging"
+	"github.com/mzzz-zzm/galleryblue/internal/jobs"
+	"github.com/mzzz-zzm/galleryblue/internal/similarity"
 	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
 )
 
 const maxImageSize = 5 * 1024 * 1024 // 5MB
-const thumbnailMaxWidth = 300
-const thumbnailMaxHeight = 200
+
+const (
+	maxTagsPerImage = 20
+	maxTagLength    = 50
+)
 
 // ImageServer implements the ImageService
 type ImageServer struct{}
 
-// generateThumbnail creates a smaller version of the image for gallery display
-func generateThumbnail(data []byte, maxWidth, maxHeight int) ([]byte, error) {
-	img, _, err := image.Decode(bytes.NewReader(data))
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+// metadataPrivacyToDB converts an API privacy level to its database value.
+// UNSPECIFIED maps to "" (inherit the owner's default); ok is false for
+// unknown values.
+func metadataPrivacyToDB(p usersv1.MetadataPrivacy) (level string, ok bool) {
+	switch p {
+	case usersv1.MetadataPrivacy_METADATA_PRIVACY_UNSPECIFIED:
+		return "", true
+	case usersv1.MetadataPrivacy_METADATA_PRIVACY_KEEP:
+		return imaging.MetadataKeep, true
+	case usersv1.MetadataPrivacy_METADATA_PRIVACY_STRIP_LOCATION:
+		return imaging.MetadataStripLocation, true
+	case usersv1.MetadataPrivacy_METADATA_PRIVACY_STRIP_ALL:
+		return imaging.MetadataStripAll, true
 	}
+	return "", false
+}
 
-	bounds := img.Bounds()
-	origWidth := bounds.Dx()
-	origHeight := bounds.Dy()
+// metadataPrivacyFromDB converts a database privacy level to the API enum
+func metadataPrivacyFromDB(level string) usersv1.MetadataPrivacy {
+	switch level {
+	case imaging.MetadataKeep:
+		return usersv1.MetadataPrivacy_METADATA_PRIVACY_KEEP
+	case imaging.MetadataStripLocation:
+		return usersv1.MetadataPrivacy_METADATA_PRIVACY_STRIP_LOCATION
+	case imaging.MetadataStripAll:
+		return usersv1.MetadataPrivacy_METADATA_PRIVACY_STRIP_ALL
+	}
+	return usersv1.MetadataPrivacy_METADATA_PRIVACY_UNSPECIFIED
+}
 
-	// Calculate new dimensions maintaining aspect ratio
-	newWidth := maxWidth
-	newHeight := maxHeight
+// visibilityToDB converts an API visibility to its database value.
+// UNSPECIFIED maps to "" (use the owner's default); ok is false for unknown
+// values.
+func visibilityToDB(v usersv1.Visibility) (visibility string, ok bool) {
+	switch v {
+	case usersv1.Visibility_VISIBILITY_UNSPECIFIED:
+		return "", true
+	case usersv1.Visibility_VISIBILITY_PUBLIC:
+		return db.VisibilityPublic, true
+	case usersv1.Visibility_VISIBILITY_UNLISTED:
+		return db.VisibilityUnlisted, true
+	case usersv1.Visibility_VISIBILITY_PRIVATE:
+		return db.VisibilityPrivate, true
+	}
+	return "", false
+}
 
-	widthRatio := float64(maxWidth) / float64(origWidth)
-	heightRatio := float64(maxHeight) / float64(origHeight)
+// visibilityFromDB converts a database visibility to the API enum
+func visibilityFromDB(visibility string) usersv1.Visibility {
+	switch visibility {
+	case db.VisibilityPublic:
+		return usersv1.Visibility_VISIBILITY_PUBLIC
+	case db.VisibilityUnlisted:
+		return usersv1.Visibility_VISIBILITY_UNLISTED
+	case db.VisibilityPrivate:
+		return usersv1.Visibility_VISIBILITY_PRIVATE
+	}
+	return usersv1.Visibility_VISIBILITY_UNSPECIFIED
+}
 
-	if widthRatio < heightRatio {
-		newHeight = int(float64(origHeight) * widthRatio)
-	} else {
-		newWidth = int(float64(origWidth) * heightRatio)
+// processingStatusFromDB converts a database processing state to the API enum
+func processingStatusFromDB(status string) usersv1.ProcessingStatus {
+	switch status {
+	case db.ProcessingPending:
+		return usersv1.ProcessingStatus_PROCESSING_STATUS_PENDING
+	case db.ProcessingInProgress:
+		return usersv1.ProcessingStatus_PROCESSING_STATUS_PROCESSING
+	case db.ProcessingReady:
+		return usersv1.ProcessingStatus_PROCESSING_STATUS_READY
+	case db.ProcessingFailed:
+		return usersv1.ProcessingStatus_PROCESSING_STATUS_FAILED
 	}
+	return usersv1.ProcessingStatus_PROCESSING_STATUS_UNSPECIFIED
+}
 
-	// Create thumbnail
-	thumbnail := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
-	draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), img, img.Bounds(), draw.Over, nil)
+// normalizeTag lowercases a tag and joins its words with hyphens. ok is
+// false for empty or overlong tags and for tags containing anything other
+// than letters, digits, '-', '_' and '.'.
+func normalizeTag(tag string) (string, bool) {
+	tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+		return "", false
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' && r != '.' {
+			return "", false
+		}
+	}
+	return tag, true
+}
 
-	// Encode as JPEG
-	var buf bytes.Buffer
-	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 70}); err != nil {
-		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+// normalizeTags normalizes and de-duplicates tags, keeping their order
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, t := range tags {
+		tag, ok := normalizeTag(t)
+		if !ok {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid tag %q", t))
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTagsPerImage {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("at most %d tags per image", maxTagsPerImage))
 	}
+	return normalized, nil
+}
 
-	return buf.Bytes(), nil
+// imageInfoToProto converts a gallery summary to its API form
+func imageInfoToProto(img db.ImageInfo) *usersv1.ImageInfo {
+	return &usersv1.ImageInfo{
+		Id:               img.ID,
+		OwnerId:          img.OwnerID,
+		OwnerDisplayName: img.OwnerDisplayName,
+		Filename:         img.Filename,
+		Title:            img.Title,
+		CreatedAt:        img.CreatedAt,
+		Thumbnail:        img.Thumbnail,
+		Visibility:       visibilityFromDB(img.Visibility),
+		Blurhash:         img.BlurHash,
+		Lqip:             img.LQIP,
+		Palette:          img.Palette,
+		DominantColor:    imageColors[img.DominantColor],
+		LikeCount:        int32(img.LikeCount),
+		LikedByMe:        img.LikedByMe,
+	}
+}
+
+// imageColors maps dominant color names to the API enum
+var imageColors = map[string]usersv1.ImageColor{
+	imaging.ColorBlack:  usersv1.ImageColor_IMAGE_COLOR_BLACK,
+	imaging.ColorGray:   usersv1.ImageColor_IMAGE_COLOR_GRAY,
+	imaging.ColorWhite:  usersv1.ImageColor_IMAGE_COLOR_WHITE,
+	imaging.ColorRed:    usersv1.ImageColor_IMAGE_COLOR_RED,
+	imaging.ColorOrange: usersv1.ImageColor_IMAGE_COLOR_ORANGE,
+	imaging.ColorBrown:  usersv1.ImageColor_IMAGE_COLOR_BROWN,
+	imaging.ColorYellow: usersv1.ImageColor_IMAGE_COLOR_YELLOW,
+	imaging.ColorGreen:  usersv1.ImageColor_IMAGE_COLOR_GREEN,
+	imaging.ColorBlue:   usersv1.ImageColor_IMAGE_COLOR_BLUE,
+	imaging.ColorPurple: usersv1.ImageColor_IMAGE_COLOR_PURPLE,
+	imaging.ColorPink:   usersv1.ImageColor_IMAGE_COLOR_PINK,
+}
+
+// imageProcessingError maps imaging failures to connect errors
+func imageProcessingError(err error) error {
+	switch {
+	case errors.Is(err, imaging.ErrInvalidImage), errors.Is(err, imaging.ErrImageTooLarge),
+		errors.Is(err, imaging.ErrInvalidEdit):
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	case errors.Is(err, imaging.ErrDecodeTimeout):
+		return connect.NewError(connect.CodeResourceExhausted, err)
+	case errors.Is(err, context.Canceled):
+		return connect.NewError(connect.CodeCanceled, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return connect.NewError(connect.CodeDeadlineExceeded, err)
+	}
+	return connect.NewError(connect.CodeInternal, fmt.Errorf("failed to process image: %w", err))
 }
 
 // UploadImage uploads a new image (authenticated user becomes owner)
@@ -70,31 +205,49 @@ func (s *ImageServer) UploadImage(
 	}
 
 	// Validate request
-	if req.Msg.Filename == "" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("filename is required"))
+	if err := validateImageContent(ctx, req.Msg.Filename, req.Msg.ContentType, req.Msg.Data); err != nil {
+		return nil, err
+	}
+	metadataPrivacy, ok := metadataPrivacyToDB(req.Msg.MetadataPrivacy)
+	if !ok {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid metadata privacy"))
 	}
-	if req.Msg.ContentType != "image/jpeg" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("only JPEG images are supported"))
+	visibility, ok := visibilityToDB(req.Msg.Visibility)
+	if !ok {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid visibility"))
 	}
-	if len(req.Msg.Data) == 0 {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image data is required"))
+	tags, err := normalizeTags(req.Msg.Tags)
+	if err != nil {
+		return nil, err
 	}
-	if len(req.Msg.Data) > maxImageSize {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image too large (max 5MB)"))
+
+	// Optionally return the user's existing copy of identical bytes
+	if req.Msg.SkipDuplicate {
+		existingID, err := db.FindImageByUploadHash(ctx, userID, db.ContentHash(req.Msg.Data))
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+		}
+		if existingID != "" {
+			return connect.NewResponse(&usersv1.UploadImageResponse{
+				ImageId:   existingID,
+				Duplicate: true,
+			}), nil
+		}
 	}
 
-	// Generate thumbnail
-	thumbnail, err := generateThumbnail(req.Msg.Data, thumbnailMaxWidth, thumbnailMaxHeight)
+	// Thumbnail generation (and optional orientation normalization) runs
+	// in the background job queue
+	payload, err := json.Marshal(jobs.ProcessImagePayload{
+		NormalizeOrientation: req.Msg.NormalizeOrientation,
+	})
 	if err != nil {
-		// Log error but continue without thumbnail
-		fmt.Printf("Warning: failed to generate thumbnail: %v\n", err)
-		thumbnail = nil
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to encode job: %w", err))
 	}
 
 	imageID, err := db.CreateImage(ctx, userID, req.Msg.Filename, req.Msg.ContentType,
-		req.Msg.Data, thumbnail, req.Msg.Title, req.Msg.Description)
+		req.Msg.Data, req.Msg.Title, req.Msg.Description, metadataPrivacy, visibility, tags, payload)
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to create image: %w", err))
+		return nil, quotaError(err, "failed to create image")
 	}
 
 	return connect.NewResponse(&usersv1.UploadImageResponse{
@@ -102,62 +255,362 @@ func (s *ImageServer) UploadImage(
 	}), nil
 }
 
-// GetImage retrieves a single image by ID (public)
+// validateImageContent checks an uploaded file, including its declared
+// dimensions, and then decodes it once so an image we can't decode is
+// rejected outright and a corrupt body never reaches the queue
+func validateImageContent(ctx context.Context, filename, contentType string, data []byte) error {
+	if filename == "" {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("filename is required"))
+	}
+	if contentType != "image/jpeg" {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("only JPEG images are supported"))
+	}
+	if len(data) == 0 {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("image data is required"))
+	}
+	if len(data) > maxImageSize {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("image too large (max 5MB)"))
+	}
+	if _, format, err := imaging.Validate(data); err != nil {
+		return imageProcessingError(err)
+	} else if format != "jpeg" {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("only JPEG images are supported"))
+	}
+	if _, err := imaging.Decode(ctx, data); err != nil {
+		return imageProcessingError(err)
+	}
+	return nil
+}
+
+// ReplaceImageContent uploads new content for an existing image (owner
+// only). Processing runs in the background as for new uploads.
+func (s *ImageServer) ReplaceImageContent(
+	ctx context.Context,
+	req *connect.Request[usersv1.ReplaceImageContentRequest],
+) (*connect.Response[usersv1.ReplaceImageContentResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageEdit, "you can only replace your own images"); err != nil {
+		return nil, err
+	}
+	if err := validateImageContent(ctx, req.Msg.Filename, req.Msg.ContentType, req.Msg.Data); err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(jobs.ProcessImagePayload{
+		NormalizeOrientation: req.Msg.NormalizeOrientation,
+	})
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to encode job: %w", err))
+	}
+
+	version, err := db.ReplaceImageContent(ctx, req.Msg.Id, req.Msg.Filename, req.Msg.ContentType, req.Msg.Data, payload)
+	if err != nil {
+		return nil, quotaError(err, "failed to replace image")
+	}
+	if version == 0 {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	}
+
+	return connect.NewResponse(&usersv1.ReplaceImageContentResponse{
+		ContentVersion: int32(version),
+	}), nil
+}
+
+// ListImageVersions returns the content versions of an image (owner only)
+func (s *ImageServer) ListImageVersions(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListImageVersionsRequest],
+) (*connect.Response[usersv1.ListImageVersionsResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageEdit, "you can only view versions of your own images"); err != nil {
+		return nil, err
+	}
+
+	versions, err := db.ListImageVersions(ctx, req.Msg.Id)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	var pbVersions []*usersv1.ImageVersion
+	for _, v := range versions {
+		pbVersions = append(pbVersions, &usersv1.ImageVersion{
+			Version:     int32(v.Version),
+			Filename:    v.Filename,
+			ContentType: v.ContentType,
+			Size:        int64(v.Size),
+			Width:       int32(v.Width),
+			Height:      int32(v.Height),
+			CreatedAt:   v.CreatedAt,
+			ReplacedAt:  v.ReplacedAt,
+			Current:     v.Current,
+		})
+	}
+
+	return connect.NewResponse(&usersv1.ListImageVersionsResponse{
+		Versions: pbVersions,
+	}), nil
+}
+
+// RestoreImageVersion makes an earlier version of an image's content
+// current again (owner only)
+func (s *ImageServer) RestoreImageVersion(
+	ctx context.Context,
+	req *connect.Request[usersv1.RestoreImageVersionRequest],
+) (*connect.Response[usersv1.RestoreImageVersionResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageEdit, "you can only restore versions of your own images"); err != nil {
+		return nil, err
+	}
+	if req.Msg.Version <= 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("version is required"))
+	}
+
+	// Stored versions were already normalized if requested when uploaded
+	payload, err := json.Marshal(jobs.ProcessImagePayload{})
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to encode job: %w", err))
+	}
+
+	version, err := db.RestoreImageVersion(ctx, req.Msg.Id, int(req.Msg.Version), payload)
+	if err != nil {
+		return nil, quotaError(err, "failed to restore version")
+	}
+	if version == 0 {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("version not found"))
+	}
+
+	return connect.NewResponse(&usersv1.RestoreImageVersionResponse{
+		ContentVersion: int32(version),
+	}), nil
+}
+
+// GetImage retrieves a single image by ID. Public and unlisted images are
+// open to anyone; private images to the owner and members of albums
+// containing them.
 func (s *ImageServer) GetImage(
 	ctx context.Context,
 	req *connect.Request[usersv1.GetImageRequest],
 ) (*connect.Response[usersv1.GetImageResponse], error) {
-	if req.Msg.Id == "" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image id is required"))
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageView, "image not found"); err != nil {
+		return nil, err
 	}
 
-	img, err := db.GetImageByID(ctx, req.Msg.Id)
+	resp, err := loadImage(ctx, req.Msg.Id, userID, viewerKey(req), req.Msg.Original)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(resp), nil
+}
+
+// viewerKey identifies the caller for view counting: their user ID, or the
+// connecting address for anonymous callers
+func viewerKey(req connect.AnyRequest) string {
+	if userID := req.Header().Get("X-User-ID"); userID != "" {
+		return userID
+	}
+	addr := req.Peer().Addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "ip:" + addr
+}
+
+// renditions caches rendered images by renditionKey, so repeated views of
+// an edited or watermarked image don't re-render it
+var renditions = newLRUCache[[]byte](64 << 20)
+
+// renditionKey identifies a rendering of an image: its content version,
+// the edit recipe applied ("" for none) and the watermark version ("" for
+// none). Any change to these produces a new key; stale entries age out.
+func renditionKey(img *db.Image, edits []byte, watermark string) string {
+	return fmt.Sprintf("%s/%d/%s/%s", img.ID, img.ContentVersion, edits, watermark)
+}
+
+// loadImage fetches an image viewerID has already been authorized for,
+// counting a view (once per viewer key and window) unless viewerID is the
+// owner. The image is rendered with its edits unless the owner asks for
+// the original. Only the owner gets a clean image; everyone else receives
+// it watermarked (if the owner or site has a watermark) with metadata
+// stripped according to the image's privacy setting.
+func loadImage(ctx context.Context, imageID, viewerID, viewer string, original bool) (*usersv1.GetImageResponse, error) {
+	img, err := db.GetImageByID(ctx, imageID)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
 	}
-	if img == nil {
+	if img == nil || img.Trashed {
 		return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
 	}
+	if original && viewerID != img.OwnerID {
+		return nil, connect.NewError(connect.CodePermissionDenied, errors.New("only the owner can view the original"))
+	}
+	edits, err := decodeEdits(img.Edits)
+	if err != nil {
+		return nil, err
+	}
+
+	var watermark *imaging.Watermark
+	var watermarkVersion string
+	if viewerID != img.OwnerID {
+		if watermark, watermarkVersion, err = watermarkFor(ctx, img.OwnerID); err != nil {
+			return nil, err
+		}
+	}
+	renderEdits, recipe := edits, img.Edits
+	if original {
+		renderEdits, recipe = nil, nil
+	}
 
-	return connect.NewResponse(&usersv1.GetImageResponse{
+	data := img.Data
+	if len(renderEdits) > 0 || watermark != nil {
+		key := renditionKey(img, recipe, watermarkVersion)
+		rendered, ok := renditions.Get(key)
+		if !ok {
+			if rendered, err = imaging.Render(ctx, data, renderEdits, watermark); err != nil {
+				return nil, imageProcessingError(err)
+			}
+			renditions.Add(key, rendered, len(rendered))
+		}
+		data = rendered
+	}
+	if viewerID != img.OwnerID {
+		data, err = imaging.ApplyMetadataPrivacy(data, img.EffectiveMetadataPrivacy())
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to strip metadata: %w", err))
+		}
+		if err := db.RecordImageView(ctx, img.ID, viewer); err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+		}
+	}
+
+	return &usersv1.GetImageResponse{
 		Id:               img.ID,
 		OwnerId:          img.OwnerID,
 		OwnerDisplayName: img.OwnerDisplayName,
 		Filename:         img.Filename,
 		ContentType:      img.ContentType,
-		Data:             img.Data,
+		Data:             data,
 		Title:            img.Title,
 		Description:      img.Description,
 		CreatedAt:        img.CreatedAt,
-	}), nil
+		MetadataPrivacy:  metadataPrivacyFromDB(img.EffectiveMetadataPrivacy()),
+		ProcessingStatus: processingStatusFromDB(img.ProcessingStatus),
+		ProcessingError:  img.ProcessingError,
+		Width:            int32(img.Width),
+		Height:           int32(img.Height),
+		Tags:             img.Tags,
+		Visibility:       visibilityFromDB(img.Visibility),
+		ContentVersion:   int32(img.ContentVersion),
+		MetadataVersion:  int32(img.MetadataVersion),
+		Edits:            editsToProto(edits),
+	}, nil
+}
+
+// imageSortToDB converts an API sort order to its database value.
+// UNSPECIFIED maps to newest first; ok is false for unknown values.
+func imageSortToDB(sort usersv1.ImageSort) (string, bool) {
+	switch sort {
+	case usersv1.ImageSort_IMAGE_SORT_UNSPECIFIED, usersv1.ImageSort_IMAGE_SORT_NEWEST:
+		return db.SortNewest, true
+	case usersv1.ImageSort_IMAGE_SORT_OLDEST:
+		return db.SortOldest, true
+	case usersv1.ImageSort_IMAGE_SORT_TITLE:
+		return db.SortTitle, true
+	case usersv1.ImageSort_IMAGE_SORT_MOST_VIEWED:
+		return db.SortMostViewed, true
+	case usersv1.ImageSort_IMAGE_SORT_MOST_LIKED:
+		return db.SortMostLiked, true
+	}
+	return "", false
+}
+
+// maxOwnerFilter caps the owner IDs a listing can be filtered by
+const maxOwnerFilter = 100
+
+// imageFilter builds a listing filter from a ListImages request
+func imageFilter(msg *usersv1.ListImagesRequest) (db.ImageFilter, error) {
+	filter := db.ImageFilter{
+		OwnerIDs:       msg.OwnerIds,
+		ContentType:    msg.ContentType,
+		HasDescription: msg.HasDescription,
+		MinWidth:       int(msg.MinWidth),
+		MinHeight:      int(msg.MinHeight),
+	}
+	if len(filter.OwnerIDs) > maxOwnerFilter {
+		return filter, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("at most %d owner ids", maxOwnerFilter))
+	}
+	for _, id := range filter.OwnerIDs {
+		if id == "" {
+			return filter, connect.NewError(connect.CodeInvalidArgument, errors.New("owner id cannot be empty"))
+		}
+	}
+	if filter.MinWidth < 0 || filter.MinHeight < 0 {
+		return filter, connect.NewError(connect.CodeInvalidArgument, errors.New("minimum dimensions cannot be negative"))
+	}
+	if msg.DominantColor != usersv1.ImageColor_IMAGE_COLOR_UNSPECIFIED {
+		for name, c := range imageColors {
+			if c == msg.DominantColor {
+				filter.DominantColor = name
+			}
+		}
+		if filter.DominantColor == "" {
+			return filter, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid dominant color"))
+		}
+	}
+	var err error
+	if filter.CreatedAfter, err = parseOptionalTime(msg.CreatedAfter); err != nil {
+		return filter, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid created_after: %w", err))
+	}
+	if filter.CreatedBefore, err = parseOptionalTime(msg.CreatedBefore); err != nil {
+		return filter, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid created_before: %w", err))
+	}
+	return filter, nil
 }
 
-// ListImages returns all images (public gallery)
+// ListImages returns public images (public gallery)
 func (s *ImageServer) ListImages(
 	ctx context.Context,
 	req *connect.Request[usersv1.ListImagesRequest],
 ) (*connect.Response[usersv1.ListImagesResponse], error) {
-	images, total, err := db.ListImages(ctx, int(req.Msg.Limit), int(req.Msg.Offset))
+	sort, ok := imageSortToDB(req.Msg.Sort)
+	if !ok {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid sort"))
+	}
+	page, err := imagePage(sort, req.Msg.Limit, req.Msg.Offset, req.Msg.PageToken, req.Msg.IncludeTotal)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := imageFilter(req.Msg)
+	if err != nil {
+		return nil, err
+	}
+	mask, err := checkReadMask(req.Msg.ReadMask, &usersv1.ImageInfo{})
+	if err != nil {
+		return nil, err
+	}
+	page.OmitThumbnails = !maskIncludes(mask, "thumbnail")
+	page.ViewerID = req.Header().Get("X-User-ID")
+
+	images, next, total, err := db.ListImages(ctx, filter, page)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
 	}
 
+	watermarks := newThumbnailWatermarks(req.Header().Get("X-User-ID"))
 	var pbImages []*usersv1.ImageInfo
 	for _, img := range images {
-		pbImages = append(pbImages, &usersv1.ImageInfo{
-			Id:               img.ID,
-			OwnerId:          img.OwnerID,
-			OwnerDisplayName: img.OwnerDisplayName,
-			Filename:         img.Filename,
-			Title:            img.Title,
-			CreatedAt:        img.CreatedAt,
-			Thumbnail:        img.Thumbnail,
-		})
+		if err := watermarks.apply(ctx, &img); err != nil {
+			return nil, err
+		}
+		pbImage := imageInfoToProto(img)
+		applyReadMask(pbImage, mask)
+		pbImages = append(pbImages, pbImage)
 	}
 
 	return connect.NewResponse(&usersv1.ListImagesResponse{
-		Images: pbImages,
-		Total:  int32(total),
+		Images:        pbImages,
+		Total:         int32(total),
+		NextPageToken: encodePageToken(sort, next),
 	}), nil
 }
 
@@ -171,27 +624,25 @@ func (s *ImageServer) ListMyImages(
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
 	}
 
-	images, total, err := db.ListImagesByOwner(ctx, userID, int(req.Msg.Limit), int(req.Msg.Offset))
+	page, err := imagePage(db.SortNewest, req.Msg.Limit, req.Msg.Offset, req.Msg.PageToken, req.Msg.IncludeTotal)
+	if err != nil {
+		return nil, err
+	}
+	page.ViewerID = userID
+	images, next, total, err := db.ListImagesByOwner(ctx, userID, page)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
 	}
 
 	var pbImages []*usersv1.ImageInfo
 	for _, img := range images {
-		pbImages = append(pbImages, &usersv1.ImageInfo{
-			Id:               img.ID,
-			OwnerId:          img.OwnerID,
-			OwnerDisplayName: img.OwnerDisplayName,
-			Filename:         img.Filename,
-			Title:            img.Title,
-			CreatedAt:        img.CreatedAt,
-			Thumbnail:        img.Thumbnail,
-		})
+		pbImages = append(pbImages, imageInfoToProto(img))
 	}
 
 	return connect.NewResponse(&usersv1.ListMyImagesResponse{
-		Images: pbImages,
-		Total:  int32(total),
+		Images:        pbImages,
+		Total:         int32(total),
+		NextPageToken: encodePageToken(db.SortNewest, next),
 	}), nil
 }
 
@@ -201,30 +652,21 @@ func (s *ImageServer) UpdateImage(
 	req *connect.Request[usersv1.UpdateImageRequest],
 ) (*connect.Response[usersv1.UpdateImageResponse], error) {
 	userID := req.Header().Get("X-User-ID")
-	if userID == "" {
-		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageEdit, "you can only edit your own images"); err != nil {
+		return nil, err
 	}
 
-	if req.Msg.Id == "" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image id is required"))
-	}
-
-	// Verify ownership
-	ownerID, err := db.GetImageOwner(ctx, req.Msg.Id)
+	// Get current values for fields not being updated
+	img, err := db.GetImageByID(ctx, req.Msg.Id)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
 	}
-	if ownerID == "" {
+	if img == nil {
 		return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
 	}
-	if ownerID != userID {
-		return nil, connect.NewError(connect.CodePermissionDenied, errors.New("you can only edit your own images"))
-	}
-
-	// Get current values for fields not being updated
-	img, err := db.GetImageByID(ctx, req.Msg.Id)
+	expectedVersion, err := expectedMetadataVersion(req.Msg.ExpectedMetadataVersion, img)
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+		return nil, err
 	}
 
 	newTitle := img.Title
@@ -235,49 +677,631 @@ func (s *ImageServer) UpdateImage(
 	if req.Msg.Description != nil {
 		newDescription = *req.Msg.Description
 	}
+	if req.Msg.MetadataPrivacy != nil {
+		level, ok := metadataPrivacyToDB(*req.Msg.MetadataPrivacy)
+		if !ok {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid metadata privacy"))
+		}
+		img.MetadataPrivacy = level
+	}
+	var newTags []string
+	if req.Msg.Tags != nil {
+		if newTags, err = normalizeTags(req.Msg.Tags.Tags); err != nil {
+			return nil, err
+		}
+		img.Tags = newTags
+	}
+	if req.Msg.Visibility != nil {
+		visibility, ok := visibilityToDB(*req.Msg.Visibility)
+		if !ok {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid visibility"))
+		}
+		if visibility == "" {
+			owner, err := db.GetUserByID(ctx, userID)
+			if err != nil {
+				return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+			}
+			if owner == nil {
+				return nil, connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+			}
+			visibility = owner.DefaultVisibility
+		}
+		img.Visibility = visibility
+	}
 
-	if err := db.UpdateImage(ctx, req.Msg.Id, newTitle, newDescription); err != nil {
+	version, err := db.UpdateImage(ctx, req.Msg.Id, userID, newTitle, newDescription, img.MetadataPrivacy, img.Visibility, newTags, expectedVersion)
+	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to update image: %w", err))
 	}
+	if version == 0 {
+		return nil, metadataConflict(expectedVersion)
+	}
 
 	return connect.NewResponse(&usersv1.UpdateImageResponse{
-		Id:          req.Msg.Id,
-		Title:       newTitle,
-		Description: newDescription,
+		Id:              req.Msg.Id,
+		Title:           newTitle,
+		Description:     newDescription,
+		MetadataPrivacy: metadataPrivacyFromDB(img.EffectiveMetadataPrivacy()),
+		Tags:            img.Tags,
+		Visibility:      visibilityFromDB(img.Visibility),
+		MetadataVersion: int32(version),
+	}), nil
+}
+
+// expectedMetadataVersion checks a request's expected metadata version
+// against the image as read, returning it in the form db.UpdateImage takes.
+// The database re-checks it when applying the update.
+func expectedMetadataVersion(expected *int32, img *db.Image) (*int, error) {
+	if expected == nil {
+		return nil, nil
+	}
+	v := int(*expected)
+	if v != img.MetadataVersion {
+		return nil, metadataConflict(&v)
+	}
+	return &v, nil
+}
+
+// metadataConflict is the error for an update db.UpdateImage didn't apply:
+// the image changed since the expected version, or it was deleted
+func metadataConflict(expectedVersion *int) error {
+	if expectedVersion == nil {
+		return connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	}
+	return connect.NewError(connect.CodeAborted, errors.New("image was modified by someone else; reload and try again"))
+}
+
+// imageRevisionToProto converts a database revision to its API form
+func imageRevisionToProto(r db.ImageRevision) *usersv1.ImageRevision {
+	return &usersv1.ImageRevision{
+		Version:                 int32(r.Version),
+		EditedBy:                r.EditedBy,
+		EditedByDisplayName:     r.EditedByDisplayName,
+		CreatedAt:               r.CreatedAt,
+		Title:                   r.Title,
+		Description:             r.Description,
+		MetadataPrivacy:         metadataPrivacyFromDB(r.MetadataPrivacy),
+		Visibility:              visibilityFromDB(r.Visibility),
+		Tags:                    r.Tags,
+		PreviousTitle:           r.PreviousTitle,
+		PreviousDescription:     r.PreviousDescription,
+		PreviousMetadataPrivacy: metadataPrivacyFromDB(r.PreviousMetadataPrivacy),
+		PreviousVisibility:      visibilityFromDB(r.PreviousVisibility),
+		PreviousTags:            r.PreviousTags,
+	}
+}
+
+// ListImageRevisions returns the metadata history of an image (owner only)
+func (s *ImageServer) ListImageRevisions(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListImageRevisionsRequest],
+) (*connect.Response[usersv1.ListImageRevisionsResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageEdit, "you can only view the history of your own images"); err != nil {
+		return nil, err
+	}
+
+	revisions, total, err := db.ListImageRevisions(ctx, req.Msg.Id, int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	var pbRevisions []*usersv1.ImageRevision
+	for _, r := range revisions {
+		pbRevisions = append(pbRevisions, imageRevisionToProto(r))
+	}
+
+	return connect.NewResponse(&usersv1.ListImageRevisionsResponse{
+		Revisions: pbRevisions,
+		Total:     int32(total),
+	}), nil
+}
+
+// RevertImageRevision restores an image's metadata from an earlier
+// revision (owner only)
+func (s *ImageServer) RevertImageRevision(
+	ctx context.Context,
+	req *connect.Request[usersv1.RevertImageRevisionRequest],
+) (*connect.Response[usersv1.RevertImageRevisionResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageEdit, "you can only edit your own images"); err != nil {
+		return nil, err
+	}
+
+	img, err := db.GetImageByID(ctx, req.Msg.Id)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if img == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	}
+	expectedVersion, err := expectedMetadataVersion(req.Msg.ExpectedMetadataVersion, img)
+	if err != nil {
+		return nil, err
+	}
+
+	revision, err := db.GetImageRevision(ctx, req.Msg.Id, int(req.Msg.Version))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if revision == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("revision not found"))
+	}
+
+	tags := revision.Tags
+	if tags == nil {
+		tags = []string{} // clear, rather than keep, the current tags
+	}
+	version, err := db.UpdateImage(ctx, req.Msg.Id, userID, revision.Title, revision.Description,
+		revision.MetadataPrivacy, revision.Visibility, tags, expectedVersion)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to update image: %w", err))
+	}
+	if version == 0 {
+		return nil, metadataConflict(expectedVersion)
+	}
+
+	return connect.NewResponse(&usersv1.RevertImageRevisionResponse{
+		MetadataVersion: int32(version),
 	}), nil
 }
 
-// DeleteImage removes an image (owner only)
+// DeleteImage moves an image to its owner's trash (owner only)
 func (s *ImageServer) DeleteImage(
 	ctx context.Context,
 	req *connect.Request[usersv1.DeleteImageRequest],
 ) (*connect.Response[usersv1.DeleteImageResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageDelete, "you can only delete your own images"); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.TrashImage(ctx, req.Msg.Id); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to delete image: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.DeleteImageResponse{
+		Success: true,
+	}), nil
+}
+
+// ListTrash returns the caller's trashed images
+func (s *ImageServer) ListTrash(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListTrashRequest],
+) (*connect.Response[usersv1.ListTrashResponse], error) {
 	userID := req.Header().Get("X-User-ID")
 	if userID == "" {
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
 	}
 
-	if req.Msg.Id == "" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image id is required"))
+	images, total, err := db.ListTrash(ctx, userID, jobs.TrashRetention(), int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	var pbImages []*usersv1.TrashedImage
+	for _, img := range images {
+		pbImages = append(pbImages, &usersv1.TrashedImage{
+			Image:     imageInfoToProto(img.ImageInfo),
+			DeletedAt: img.DeletedAt,
+			PurgeAt:   img.PurgeAt,
+		})
+	}
+
+	return connect.NewResponse(&usersv1.ListTrashResponse{
+		Images: pbImages,
+		Total:  int32(total),
+	}), nil
+}
+
+// RestoreImage takes one of the caller's images out of the trash
+func (s *ImageServer) RestoreImage(
+	ctx context.Context,
+	req *connect.Request[usersv1.RestoreImageRequest],
+) (*connect.Response[usersv1.RestoreImageResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageRestore, "you can only restore your own images"); err != nil {
+		return nil, err
 	}
 
-	// Verify ownership
-	ownerID, err := db.GetImageOwner(ctx, req.Msg.Id)
+	restored, err := db.RestoreImage(ctx, req.Msg.Id, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to restore image: %w", err))
+	}
+	if !restored {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("image is not in the trash"))
+	}
+
+	return connect.NewResponse(&usersv1.RestoreImageResponse{
+		Success: true,
+	}), nil
+}
+
+// EmptyTrash permanently deletes all of the caller's trashed images
+func (s *ImageServer) EmptyTrash(
+	ctx context.Context,
+	req *connect.Request[usersv1.EmptyTrashRequest],
+) (*connect.Response[usersv1.EmptyTrashResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	// Purge in batches so a large trash doesn't hold one long transaction
+	const batchSize = 500
+	deleted := 0
+	for {
+		n, err := db.PurgeTrash(ctx, userID, nil, batchSize)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to empty trash: %w", err))
+		}
+		deleted += n
+		if n < batchSize {
+			break
+		}
+	}
+
+	return connect.NewResponse(&usersv1.EmptyTrashResponse{
+		Deleted: int32(deleted),
+	}), nil
+}
+
+// batchResults reports the outcome of a batch request for each image in
+// ids: the reason from refused or failed if there is one, success otherwise
+func batchResults(ids []string, refused, failed map[string]string) []*usersv1.BatchImageResult {
+	results := make([]*usersv1.BatchImageResult, 0, len(ids))
+	for _, id := range ids {
+		reason, ok := refused[id]
+		if !ok {
+			reason, ok = failed[id]
+		}
+		results = append(results, &usersv1.BatchImageResult{
+			Id:      id,
+			Success: !ok,
+			Error:   reason,
+		})
+	}
+	return results
+}
+
+// BatchUpdateImages applies the same change to many of the caller's images
+// in one transaction
+func (s *ImageServer) BatchUpdateImages(
+	ctx context.Context,
+	req *connect.Request[usersv1.BatchUpdateImagesRequest],
+) (*connect.Response[usersv1.BatchUpdateImagesResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	ids, allowed, refused, err := authorizeImageBatch(ctx, userID, req.Msg.Ids, authz.ImageEdit, "you can only edit your own images")
+	if err != nil {
+		return nil, err
+	}
+
+	var patch db.ImagePatch
+	if req.Msg.MetadataPrivacy != nil {
+		level, ok := metadataPrivacyToDB(*req.Msg.MetadataPrivacy)
+		if !ok {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid metadata privacy"))
+		}
+		patch.MetadataPrivacy = &level
+	}
+	if req.Msg.Visibility != nil {
+		visibility, ok := visibilityToDB(*req.Msg.Visibility)
+		if !ok {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid visibility"))
+		}
+		if visibility == "" {
+			owner, err := db.GetUserByID(ctx, userID)
+			if err != nil {
+				return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+			}
+			if owner == nil {
+				return nil, connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+			}
+			visibility = owner.DefaultVisibility
+		}
+		patch.Visibility = &visibility
+	}
+	if patch.AddTags, err = normalizeTags(req.Msg.AddTags); err != nil {
+		return nil, err
+	}
+	if patch.RemoveTags, err = normalizeTags(req.Msg.RemoveTags); err != nil {
+		return nil, err
+	}
+	if patch.MetadataPrivacy == nil && patch.Visibility == nil && len(patch.AddTags) == 0 && len(patch.RemoveTags) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("no changes requested"))
+	}
+
+	failed := make(map[string]string)
+	var updated []string
+	if len(allowed) > 0 {
+		var overTagLimit []string
+		updated, overTagLimit, err = db.BatchUpdateImages(ctx, allowed, userID, patch, maxTagsPerImage)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to update images: %w", err))
+		}
+		for _, id := range overTagLimit {
+			failed[id] = fmt.Sprintf("at most %d tags per image", maxTagsPerImage)
+		}
+	}
+	done := make(map[string]bool, len(updated))
+	for _, id := range updated {
+		done[id] = true
+	}
+	for _, id := range allowed {
+		if _, ok := failed[id]; !ok && !done[id] {
+			failed[id] = "image not found" // deleted since it was authorized
+		}
+	}
+
+	return connect.NewResponse(&usersv1.BatchUpdateImagesResponse{
+		Results: batchResults(ids, refused, failed),
+		Updated: int32(len(updated)),
+	}), nil
+}
+
+// BatchDeleteImages moves many of the caller's images to the trash at once
+func (s *ImageServer) BatchDeleteImages(
+	ctx context.Context,
+	req *connect.Request[usersv1.BatchDeleteImagesRequest],
+) (*connect.Response[usersv1.BatchDeleteImagesResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	ids, allowed, refused, err := authorizeImageBatch(ctx, userID, req.Msg.Ids, authz.ImageDelete, "you can only delete your own images")
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	if len(allowed) > 0 {
+		if deleted, err = db.TrashImages(ctx, allowed); err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to delete images: %w", err))
+		}
+	}
+	done := make(map[string]bool, len(deleted))
+	for _, id := range deleted {
+		done[id] = true
+	}
+	failed := make(map[string]string)
+	for _, id := range allowed {
+		if !done[id] {
+			failed[id] = "image not found" // deleted since it was authorized
+		}
+	}
+
+	return connect.NewResponse(&usersv1.BatchDeleteImagesResponse{
+		Results: batchResults(ids, refused, failed),
+		Deleted: int32(len(deleted)),
+	}), nil
+}
+
+const (
+	defaultSimilarDistance = 10
+	maxSimilarDistance     = 32
+)
+
+// FindSimilarImages returns images whose perceptual hash is within a Hamming
+// distance of the given image's, closest first. Results are limited to
+// public images and the caller's own.
+func (s *ImageServer) FindSimilarImages(
+	ctx context.Context,
+	req *connect.Request[usersv1.FindSimilarImagesRequest],
+) (*connect.Response[usersv1.FindSimilarImagesResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if err := authorizeImage(ctx, userID, req.Msg.ImageId, authz.ImageView, "image not found"); err != nil {
+		return nil, err
+	}
+
+	maxDistance := defaultSimilarDistance
+	if req.Msg.MaxDistance != nil {
+		maxDistance = int(*req.Msg.MaxDistance)
+		if maxDistance < 0 || maxDistance > maxSimilarDistance {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("max distance must be between 0 and %d", maxSimilarDistance))
+		}
+	}
+	limit := int(req.Msg.Limit)
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	hashes, err := db.GetImageHashes(ctx, []string{req.Msg.ImageId})
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
 	}
-	if ownerID == "" {
-		return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	hash, ok := hashes[req.Msg.ImageId]
+	if !ok {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("image has not been processed yet"))
 	}
-	if ownerID != userID {
-		return nil, connect.NewError(connect.CodePermissionDenied, errors.New("you can only delete your own images"))
+
+	candidates, err := similarity.Search(ctx, hash, maxDistance)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("similarity index error: %w", err))
 	}
 
-	if err := db.DeleteImage(ctx, req.Msg.Id); err != nil {
-		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to delete image: %w", err))
+	// The index may be stale, so re-check every candidate's current hash
+	ids := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		if c.ImageID != req.Msg.ImageId {
+			ids = append(ids, c.ImageID)
+		}
+	}
+	current, err := db.GetImageHashes(ctx, ids)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	ids = ids[:0]
+	for id, h := range current {
+		if imaging.HammingDistance(hash, h) <= maxDistance {
+			ids = append(ids, id)
+		}
 	}
 
-	return connect.NewResponse(&usersv1.DeleteImageResponse{
-		Success: true,
+	// Only images the caller may list are loaded, so filter before limiting
+	images, err := db.ListImagesByIDs(ctx, ids, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	byID := make(map[string]db.ImageInfo, len(images))
+	var matches []similarity.Match
+	for _, img := range images {
+		byID[img.ID] = img
+		matches = append(matches, similarity.Match{ImageID: img.ID, Distance: imaging.HammingDistance(hash, current[img.ID])})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ImageID < matches[j].ImageID
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	watermarks := newThumbnailWatermarks(userID)
+	var results []*usersv1.SimilarImage
+	for _, m := range matches {
+		img := byID[m.ImageID]
+		if err := watermarks.apply(ctx, &img); err != nil {
+			return nil, err
+		}
+		results = append(results, &usersv1.SimilarImage{
+			Image:    imageInfoToProto(img),
+			Distance: int32(m.Distance),
+		})
+	}
+
+	return connect.NewResponse(&usersv1.FindSimilarImagesResponse{
+		Images: results,
+	}), nil
+}
+
+// ListImagesByTag returns public images, plus the caller's own, carrying a tag
+func (s *ImageServer) ListImagesByTag(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListImagesByTagRequest],
+) (*connect.Response[usersv1.ListImagesByTagResponse], error) {
+	tag, ok := normalizeTag(req.Msg.Tag)
+	if !ok {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid tag"))
+	}
+
+	images, total, err := db.ListImagesByTag(ctx, tag, req.Header().Get("X-User-ID"), int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	watermarks := newThumbnailWatermarks(req.Header().Get("X-User-ID"))
+	var pbImages []*usersv1.ImageInfo
+	for _, img := range images {
+		if err := watermarks.apply(ctx, &img); err != nil {
+			return nil, err
+		}
+		pbImages = append(pbImages, imageInfoToProto(img))
+	}
+
+	return connect.NewResponse(&usersv1.ListImagesByTagResponse{
+		Images: pbImages,
+		Total:  int32(total),
+	}), nil
+}
+
+// tagCountsToProto converts tag counts to their API form
+func tagCountsToProto(tags []db.TagCount) []*usersv1.TagCount {
+	var pbTags []*usersv1.TagCount
+	for _, t := range tags {
+		pbTags = append(pbTags, &usersv1.TagCount{
+			Name:  t.Name,
+			Count: int32(t.Count),
+		})
+	}
+	return pbTags
+}
+
+// ListTags returns tags in use with their counts of public images plus the
+// caller's own
+func (s *ImageServer) ListTags(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListTagsRequest],
+) (*connect.Response[usersv1.ListTagsResponse], error) {
+	tags, total, err := db.ListTags(ctx, req.Msg.OwnerId, req.Header().Get("X-User-ID"), int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.ListTagsResponse{
+		Tags:  tagCountsToProto(tags),
+		Total: int32(total),
+	}), nil
+}
+
+// AutocompleteTags suggests tags starting with a prefix, drawn from public
+// images plus the caller's own
+func (s *ImageServer) AutocompleteTags(
+	ctx context.Context,
+	req *connect.Request[usersv1.AutocompleteTagsRequest],
+) (*connect.Response[usersv1.AutocompleteTagsResponse], error) {
+	// Normalize like a tag, but allow partial input such as a trailing "-"
+	prefix := strings.Join(strings.Fields(strings.ToLower(req.Msg.Prefix)), "-")
+
+	tags, err := db.AutocompleteTags(ctx, prefix, req.Header().Get("X-User-ID"), int(req.Msg.Limit))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.AutocompleteTagsResponse{
+		Tags: tagCountsToProto(tags),
+	}), nil
+}
+
+// highlightHTML escapes search result text for HTML and wraps the matched
+// words in <mark> tags
+func highlightHTML(text string) string {
+	return strings.NewReplacer(db.HighlightStart, "<mark>", db.HighlightStop, "</mark>").Replace(html.EscapeString(text))
+}
+
+// SearchImages runs a full-text search over public images plus the caller's
+// own
+func (s *ImageServer) SearchImages(
+	ctx context.Context,
+	req *connect.Request[usersv1.SearchImagesRequest],
+) (*connect.Response[usersv1.SearchImagesResponse], error) {
+	if strings.TrimSpace(req.Msg.Query) == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("query is required"))
+	}
+
+	filter := db.SearchFilter{
+		ViewerID:    req.Header().Get("X-User-ID"),
+		OwnerID:     req.Msg.OwnerId,
+		ContentType: req.Msg.ContentType,
+	}
+	var err error
+	if filter.CreatedAfter, err = parseOptionalTime(req.Msg.CreatedAfter); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid created_after: %w", err))
+	}
+	if filter.CreatedBefore, err = parseOptionalTime(req.Msg.CreatedBefore); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid created_before: %w", err))
+	}
+
+	results, total, err := db.SearchImages(ctx, req.Msg.Query, filter, int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	watermarks := newThumbnailWatermarks(req.Header().Get("X-User-ID"))
+	var pbResults []*usersv1.SearchResult
+	for _, r := range results {
+		if err := watermarks.apply(ctx, &r.ImageInfo); err != nil {
+			return nil, err
+		}
+		pbResults = append(pbResults, &usersv1.SearchResult{
+			Image:          imageInfoToProto(r.ImageInfo),
+			Rank:           float32(r.Rank),
+			TitleHighlight: highlightHTML(r.TitleHighlight),
+			Snippet:        highlightHTML(r.Snippet),
+		})
+	}
+
+	return connect.NewResponse(&usersv1.SearchImagesResponse{
+		Results: pbResults,
+		Total:   int32(total),
 	}), nil
 }
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"connectrpc.com/connect"
+
+	"github.com/mzzz-zzm/galleryblue/internal/authz"
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// LikeImage adds the caller's like to an image they can view
+func (s *ImageServer) LikeImage(
+	ctx context.Context,
+	req *connect.Request[usersv1.LikeImageRequest],
+) (*connect.Response[usersv1.LikeImageResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageView, "image not found"); err != nil {
+		return nil, err
+	}
+
+	count, err := db.LikeImage(ctx, req.Msg.Id, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to like image: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.LikeImageResponse{
+		LikeCount: int32(count),
+	}), nil
+}
+
+// UnlikeImage removes the caller's like from an image
+func (s *ImageServer) UnlikeImage(
+	ctx context.Context,
+	req *connect.Request[usersv1.UnlikeImageRequest],
+) (*connect.Response[usersv1.UnlikeImageResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if err := authorizeImage(ctx, userID, req.Msg.Id, authz.ImageView, "image not found"); err != nil {
+		return nil, err
+	}
+
+	count, err := db.UnlikeImage(ctx, req.Msg.Id, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to unlike image: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.UnlikeImageResponse{
+		LikeCount: int32(count),
+	}), nil
+}
+
+// ListLikedImages returns the images the caller has liked
+func (s *ImageServer) ListLikedImages(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListLikedImagesRequest],
+) (*connect.Response[usersv1.ListLikedImagesResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	images, total, err := db.ListLikedImages(ctx, userID, int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	watermarks := newThumbnailWatermarks(userID)
+	var pbImages []*usersv1.ImageInfo
+	for _, img := range images {
+		if err := watermarks.apply(ctx, &img); err != nil {
+			return nil, err
+		}
+		pbImages = append(pbImages, imageInfoToProto(img))
+	}
+
+	return connect.NewResponse(&usersv1.ListLikedImagesResponse{
+		Images: pbImages,
+		Total:  int32(total),
+	}), nil
+}
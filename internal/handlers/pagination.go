@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+)
+
+// pageToken is the decoded form of an opaque page token. Sort records the
+// listing order the cursor belongs to.
+type pageToken struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"i"`
+}
+
+// encodePageToken returns the opaque token for a cursor in a listing
+// sorted by sort, or "" for nil (no more pages)
+func encodePageToken(sort string, cursor *db.ImageCursor) string {
+	if cursor == nil {
+		return ""
+	}
+	data, _ := json.Marshal(pageToken{Sort: sort, Key: cursor.Key, ID: cursor.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageToken parses a token from encodePageToken for a listing sorted
+// by sort, returning nil for ""
+func decodePageToken(sort, token string) (*db.ImageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid page token"))
+	}
+	var t pageToken
+	if err := json.Unmarshal(data, &t); err != nil || t.ID == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid page token"))
+	}
+	if t.Sort != sort {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("page token is for a different sort order"))
+	}
+	cursor := db.ImageCursor{Key: t.Key, ID: t.ID}
+	if !db.ValidImageCursor(sort, cursor) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid page token"))
+	}
+	return &cursor, nil
+}
+
+// imagePage builds a listing page from request fields
+func imagePage(sort string, limit, offset int32, token string, includeTotal bool) (db.ImagePage, error) {
+	after, err := decodePageToken(sort, token)
+	if err != nil {
+		return db.ImagePage{}, err
+	}
+	if after != nil && offset != 0 {
+		return db.ImagePage{}, connect.NewError(connect.CodeInvalidArgument, errors.New("offset cannot be combined with a page token"))
+	}
+	return db.ImagePage{
+		Sort:      sort,
+		Limit:     int(limit),
+		After:     after,
+		Offset:    int(offset),
+		WithTotal: includeTotal,
+	}, nil
+}
+
+// checkReadMask validates a read mask against msg's fields, returning nil
+// (all fields) for an unset or empty mask
+func checkReadMask(mask *fieldmaskpb.FieldMask, msg proto.Message) (*fieldmaskpb.FieldMask, error) {
+	if len(mask.GetPaths()) == 0 {
+		return nil, nil
+	}
+	if !mask.IsValid(msg) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid read mask"))
+	}
+	return mask, nil
+}
+
+// maskIncludes reports whether a mask from checkReadMask selects field
+func maskIncludes(mask *fieldmaskpb.FieldMask, field string) bool {
+	if mask == nil {
+		return true
+	}
+	for _, path := range mask.Paths {
+		if path == field {
+			return true
+		}
+	}
+	return false
+}
+
+// applyReadMask clears the fields of msg that a mask from checkReadMask
+// does not select
+func applyReadMask(msg proto.Message, mask *fieldmaskpb.FieldMask) {
+	if mask == nil {
+		return
+	}
+	m := msg.ProtoReflect()
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if fd := fields.Get(i); !maskIncludes(mask, string(fd.Name())) {
+			m.Clear(fd)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"connectrpc.com/connect"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// quotaError converts an error from a write that counts against a quota,
+// reporting an exceeded quota as ResourceExhausted
+func quotaError(err error, msg string) error {
+	switch {
+	case errors.Is(err, db.ErrStorageQuotaExceeded):
+		return connect.NewError(connect.CodeResourceExhausted, errors.New("storage quota exceeded; delete images or empty your trash to free space"))
+	case errors.Is(err, db.ErrImageQuotaExceeded):
+		return connect.NewError(connect.CodeResourceExhausted, errors.New("image quota exceeded; delete images or empty your trash to upload more"))
+	}
+	return connect.NewError(connect.CodeInternal, fmt.Errorf("%s: %w", msg, err))
+}
+
+// loadUsage returns a user's usage in its API form
+func loadUsage(ctx context.Context, userID string) (*usersv1.StorageUsage, error) {
+	u, err := db.GetUsage(ctx, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if u == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+	}
+	return &usersv1.StorageUsage{
+		BytesUsed:       u.Bytes,
+		MaxBytes:        u.MaxBytes,
+		ImageCount:      int32(u.Images),
+		MaxImages:       int32(u.MaxImages),
+		QuotaOverridden: u.Overridden,
+	}, nil
+}
+
+// GetMyUsage returns the caller's storage usage and quota
+func (s *UserServer) GetMyUsage(
+	ctx context.Context,
+	req *connect.Request[usersv1.GetMyUsageRequest],
+) (*connect.Response[usersv1.GetMyUsageResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	usage, err := loadUsage(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.GetMyUsageResponse{
+		Usage: usage,
+	}), nil
+}
+
+// GetUserUsage returns a user's storage usage and quota (admin only)
+func (s *AdminServer) GetUserUsage(
+	ctx context.Context,
+	req *connect.Request[usersv1.GetUserUsageRequest],
+) (*connect.Response[usersv1.GetUserUsageResponse], error) {
+	if err := requireAdmin(ctx, req.Header().Get("X-User-ID")); err != nil {
+		return nil, err
+	}
+	if req.Msg.UserId == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("user id is required"))
+	}
+
+	usage, err := loadUsage(ctx, req.Msg.UserId)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.GetUserUsageResponse{
+		Usage: usage,
+	}), nil
+}
+
+// SetUserQuota overrides a user's role quota (admin only)
+func (s *AdminServer) SetUserQuota(
+	ctx context.Context,
+	req *connect.Request[usersv1.SetUserQuotaRequest],
+) (*connect.Response[usersv1.SetUserQuotaResponse], error) {
+	if err := requireAdmin(ctx, req.Header().Get("X-User-ID")); err != nil {
+		return nil, err
+	}
+	if req.Msg.UserId == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("user id is required"))
+	}
+	if req.Msg.MaxBytes < 0 || req.Msg.MaxImages < 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("quota limits cannot be negative"))
+	}
+
+	found, err := db.SetUserQuota(ctx, req.Msg.UserId, req.Msg.MaxBytes, int(req.Msg.MaxImages))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to set quota: %w", err))
+	}
+	if !found {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+	}
+
+	usage, err := loadUsage(ctx, req.Msg.UserId)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.SetUserQuotaResponse{
+		Usage: usage,
+	}), nil
+}
+
+// ClearUserQuota removes a user's quota override (admin only)
+func (s *AdminServer) ClearUserQuota(
+	ctx context.Context,
+	req *connect.Request[usersv1.ClearUserQuotaRequest],
+) (*connect.Response[usersv1.ClearUserQuotaResponse], error) {
+	if err := requireAdmin(ctx, req.Header().Get("X-User-ID")); err != nil {
+		return nil, err
+	}
+	if req.Msg.UserId == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("user id is required"))
+	}
+
+	if err := db.ClearUserQuota(ctx, req.Msg.UserId); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	usage, err := loadUsage(ctx, req.Msg.UserId)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.ClearUserQuotaResponse{
+		Usage: usage,
+	}), nil
+}
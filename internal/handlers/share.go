@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"connectrpc.com/connect"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/mzzz-zzm/galleryblue/internal/authz"
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// defaultShareBaseURL is used when ShareServer.BaseURL is empty
+const defaultShareBaseURL = "http://localhost:5173/s/"
+
+// ShareServer implements the ShareService
+type ShareServer struct {
+	// BaseURL is prefixed to link tokens to build share URLs
+	BaseURL string
+}
+
+// shareLinkToProto converts a database share link to its API form
+func (s *ShareServer) shareLinkToProto(l *db.ShareLink) *usersv1.ShareLink {
+	baseURL := s.BaseURL
+	if baseURL == "" {
+		baseURL = defaultShareBaseURL
+	}
+	return &usersv1.ShareLink{
+		Id:             l.ID,
+		Token:          l.Token,
+		Url:            baseURL + l.Token,
+		ImageId:        l.ImageID,
+		AlbumId:        l.AlbumID,
+		ExpiresAt:      l.ExpiresAt,
+		MaxViews:       int32(l.MaxViews),
+		ViewCount:      int32(l.ViewCount),
+		HasPassword:    l.PasswordHash != "",
+		CreatedAt:      l.CreatedAt,
+		LastAccessedAt: l.LastAccessedAt,
+	}
+}
+
+// openShareLink looks up a link by token and checks its expiry and
+// password. It does not count an access; see countShareLinkAccess.
+func openShareLink(ctx context.Context, token, password string) (*db.ShareLink, error) {
+	if token == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("token is required"))
+	}
+	link, err := db.GetShareLinkByToken(ctx, token)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if link == nil {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("share link not found"))
+	}
+	if link.Expired {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("share link has expired"))
+	}
+	if link.PasswordHash != "" {
+		if password == "" {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("share link requires a password"))
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)); err != nil {
+			return nil, connect.NewError(connect.CodePermissionDenied, errors.New("incorrect password"))
+		}
+	}
+	return link, nil
+}
+
+// shareSessionTTL is how long a visitor can keep browsing an album after
+// opening it through a link
+const shareSessionTTL = time.Hour
+
+// shareLinkUnavailableError reports a link that has used up its views
+func shareLinkUnavailableError() error {
+	return connect.NewError(connect.CodeResourceExhausted, errors.New("share link is no longer available"))
+}
+
+// checkShareLinkViews fails early if an opened link had already used up
+// its views, so no work is done for an access that can't be counted
+func checkShareLinkViews(link *db.ShareLink) error {
+	if link.MaxViews > 0 && link.ViewCount >= link.MaxViews {
+		return shareLinkUnavailableError()
+	}
+	return nil
+}
+
+// countShareLinkAccess records one view through an opened link, failing
+// if it was revoked, expired or used up its views in the meantime. Views
+// are counted only once the response is ready.
+func countShareLinkAccess(ctx context.Context, link *db.ShareLink) error {
+	ok, err := db.RecordShareLinkAccess(ctx, link.ID)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if !ok {
+		return shareLinkUnavailableError()
+	}
+	return nil
+}
+
+// inShareSession reports whether session is a live browsing session of an
+// album link, started when the album was opened. "" is never one.
+func inShareSession(ctx context.Context, link *db.ShareLink, session string) (bool, error) {
+	if link.AlbumID == "" || session == "" {
+		return false, nil
+	}
+	ok, err := db.ShareLinkSessionValid(ctx, link.ID, session)
+	if err != nil {
+		return false, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	return ok, nil
+}
+
+// randomToken returns a new unguessable hex token
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", connect.NewError(connect.CodeInternal, fmt.Errorf("failed to generate token: %w", err))
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateShareLink creates a link to an image or album the caller owns
+func (s *ShareServer) CreateShareLink(
+	ctx context.Context,
+	req *connect.Request[usersv1.CreateShareLinkRequest],
+) (*connect.Response[usersv1.CreateShareLinkResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	switch {
+	case req.Msg.ImageId != "" && req.Msg.AlbumId != "":
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("set only one of image id and album id"))
+	case req.Msg.ImageId != "":
+		if err := authorizeImage(ctx, userID, req.Msg.ImageId, authz.ImageShare, "you can only share your own images"); err != nil {
+			return nil, err
+		}
+	case req.Msg.AlbumId != "":
+		if _, err := authorizeAlbum(ctx, userID, req.Msg.AlbumId, authz.AlbumShare); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image id or album id is required"))
+	}
+
+	expiresAt, err := parseOptionalTime(req.Msg.ExpiresAt)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid expires_at: %w", err))
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("expires_at must be in the future"))
+	}
+	if req.Msg.MaxViews < 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("max views cannot be negative"))
+	}
+
+	var passwordHash string
+	if req.Msg.Password != "" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(req.Msg.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to hash password: %w", err))
+		}
+		passwordHash = string(hashed)
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := db.CreateShareLink(ctx, token, userID, req.Msg.ImageId, req.Msg.AlbumId,
+		passwordHash, expiresAt, int(req.Msg.MaxViews))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to create share link: %w", err))
+	}
+
+	return connect.NewResponse(&usersv1.CreateShareLinkResponse{
+		Link: s.shareLinkToProto(link),
+	}), nil
+}
+
+// ListShareLinks returns the links the caller has created
+func (s *ShareServer) ListShareLinks(
+	ctx context.Context,
+	req *connect.Request[usersv1.ListShareLinksRequest],
+) (*connect.Response[usersv1.ListShareLinksResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	links, total, err := db.ListShareLinks(ctx, userID, req.Msg.ImageId, req.Msg.AlbumId, int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	var pbLinks []*usersv1.ShareLink
+	for i := range links {
+		pbLinks = append(pbLinks, s.shareLinkToProto(&links[i]))
+	}
+
+	return connect.NewResponse(&usersv1.ListShareLinksResponse{
+		Links: pbLinks,
+		Total: int32(total),
+	}), nil
+}
+
+// RevokeShareLink deletes a link the caller created
+func (s *ShareServer) RevokeShareLink(
+	ctx context.Context,
+	req *connect.Request[usersv1.RevokeShareLinkRequest],
+) (*connect.Response[usersv1.RevokeShareLinkResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+	if req.Msg.Id == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("share link id is required"))
+	}
+
+	revoked, err := db.RevokeShareLink(ctx, req.Msg.Id, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if !revoked {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("share link not found"))
+	}
+
+	return connect.NewResponse(&usersv1.RevokeShareLinkResponse{
+		Success: true,
+	}), nil
+}
+
+// GetSharedImage returns the linked image, or an image in the linked album,
+// regardless of its visibility. Each call counts as a view, except for
+// images opened from an album within its browsing session.
+func (s *ShareServer) GetSharedImage(
+	ctx context.Context,
+	req *connect.Request[usersv1.GetSharedImageRequest],
+) (*connect.Response[usersv1.GetSharedImageResponse], error) {
+	link, err := openShareLink(ctx, req.Msg.Token, req.Msg.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	imageID := link.ImageID
+	if link.AlbumID != "" {
+		if req.Msg.ImageId == "" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("image id is required"))
+		}
+		inAlbum, err := db.AlbumHasImage(ctx, link.AlbumID, req.Msg.ImageId)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+		}
+		if !inAlbum {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+		}
+		imageID = req.Msg.ImageId
+	} else if req.Msg.ImageId != "" && req.Msg.ImageId != imageID {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("image not found"))
+	}
+
+	browsing, err := inShareSession(ctx, link, req.Msg.Session)
+	if err != nil {
+		return nil, err
+	}
+	if !browsing {
+		if err := checkShareLinkViews(link); err != nil {
+			return nil, err
+		}
+	}
+	image, err := loadImage(ctx, imageID, req.Header().Get("X-User-ID"), viewerKey(req), false)
+	if err != nil {
+		return nil, err
+	}
+	if !browsing {
+		if err := countShareLinkAccess(ctx, link); err != nil {
+			return nil, err
+		}
+	}
+
+	return connect.NewResponse(&usersv1.GetSharedImageResponse{
+		Image: image,
+	}), nil
+}
+
+// GetSharedAlbum returns the linked album and a page of its images,
+// regardless of their visibility. A call without a live session opens the
+// album: it counts as a view and starts a browsing session for later pages
+// and images.
+func (s *ShareServer) GetSharedAlbum(
+	ctx context.Context,
+	req *connect.Request[usersv1.GetSharedAlbumRequest],
+) (*connect.Response[usersv1.GetSharedAlbumResponse], error) {
+	link, err := openShareLink(ctx, req.Msg.Token, req.Msg.Password)
+	if err != nil {
+		return nil, err
+	}
+	if link.AlbumID == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("share link is not for an album"))
+	}
+
+	session := req.Msg.Session
+	browsing, err := inShareSession(ctx, link, session)
+	if err != nil {
+		return nil, err
+	}
+	if !browsing {
+		if err := checkShareLinkViews(link); err != nil {
+			return nil, err
+		}
+	}
+	album, err := loadAlbum(ctx, link.AlbumID)
+	if err != nil {
+		return nil, err
+	}
+
+	images, total, err := db.ListAlbumImages(ctx, album.ID, int(req.Msg.Limit), int(req.Msg.Offset))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+
+	if !browsing {
+		if session, err = randomToken(); err != nil {
+			return nil, err
+		}
+		if err := countShareLinkAccess(ctx, link); err != nil {
+			return nil, err
+		}
+		if err := db.CreateShareLinkSession(ctx, link.ID, session, shareSessionTTL); err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+		}
+	}
+
+	watermarks := newThumbnailWatermarks(req.Header().Get("X-User-ID"))
+	var pbImages []*usersv1.ImageInfo
+	for _, img := range images {
+		if err := watermarks.apply(ctx, &img); err != nil {
+			return nil, err
+		}
+		pbImages = append(pbImages, imageInfoToProto(img))
+	}
+
+	return connect.NewResponse(&usersv1.GetSharedAlbumResponse{
+		Album:   albumToProto(album, authz.RoleNone),
+		Images:  pbImages,
+		Total:   int32(total),
+		Session: session,
+	}), nil
+}
@@ -35,9 +35,11 @@ func (s *UserServer) GetUser(
 	}
 
 	return connect.NewResponse(&usersv1.GetUserResponse{
-		Id:    user.ID,
-		Name:  user.DisplayName,
-		Email: user.Email,
+		Id:                user.ID,
+		Name:              user.DisplayName,
+		Email:             user.Email,
+		MetadataPrivacy:   metadataPrivacyFromDB(user.MetadataPrivacy),
+		DefaultVisibility: visibilityFromDB(user.DefaultVisibility),
 	}), nil
 }
 
@@ -74,6 +76,8 @@ func (s *UserServer) UpdateUser(
 	newDisplayName := user.DisplayName
 	newEmail := user.Email
 	newPasswordHash := user.PasswordHash
+	newMetadataPrivacy := user.MetadataPrivacy
+	newDefaultVisibility := user.DefaultVisibility
 
 	// Check new display name uniqueness
 	if req.Msg.NewDisplayName != nil && *req.Msg.NewDisplayName != "" {
@@ -108,14 +112,32 @@ func (s *UserServer) UpdateUser(
 		newPasswordHash = string(hashed)
 	}
 
+	// Users always have a concrete default, so UNSPECIFIED is rejected here
+	if req.Msg.NewMetadataPrivacy != nil {
+		level, ok := metadataPrivacyToDB(*req.Msg.NewMetadataPrivacy)
+		if !ok || level == "" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid metadata privacy"))
+		}
+		newMetadataPrivacy = level
+	}
+	if req.Msg.NewDefaultVisibility != nil {
+		visibility, ok := visibilityToDB(*req.Msg.NewDefaultVisibility)
+		if !ok || visibility == "" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid default visibility"))
+		}
+		newDefaultVisibility = visibility
+	}
+
 	// Update user
-	if err := db.UpdateUser(ctx, userID, newDisplayName, newEmail, newPasswordHash); err != nil {
+	if err := db.UpdateUser(ctx, userID, newDisplayName, newEmail, newPasswordHash, newMetadataPrivacy, newDefaultVisibility); err != nil {
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to update user: %w", err))
 	}
 
 	return connect.NewResponse(&usersv1.UpdateUserResponse{
-		UserId:      userID,
-		DisplayName: newDisplayName,
-		Email:       newEmail,
+		UserId:            userID,
+		DisplayName:       newDisplayName,
+		Email:             newEmail,
+		MetadataPrivacy:   metadataPrivacyFromDB(newMetadataPrivacy),
+		DefaultVisibility: visibilityFromDB(newDefaultVisibility),
 	}), nil
 }
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"unicode/utf8"
+
+	"connectrpc.com/connect"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	"github.com/mzzz-zzm/galleryblue/internal/imaging"
+	usersv1 "github.com/mzzz-zzm/galleryblue/gen/go/users/v1"
+)
+
+// watermarkLogos caches decoded watermark logos by owner and update time,
+// so a logo is decoded once per change rather than on every render
+var watermarkLogos = newLRUCache[image.Image](32 << 20)
+
+// watermarkPositions maps API watermark positions to their database values
+var watermarkPositions = map[usersv1.WatermarkPosition]string{
+	usersv1.WatermarkPosition_WATERMARK_POSITION_UNSPECIFIED:  imaging.WatermarkBottomRight,
+	usersv1.WatermarkPosition_WATERMARK_POSITION_TOP_LEFT:     imaging.WatermarkTopLeft,
+	usersv1.WatermarkPosition_WATERMARK_POSITION_TOP_RIGHT:    imaging.WatermarkTopRight,
+	usersv1.WatermarkPosition_WATERMARK_POSITION_BOTTOM_LEFT:  imaging.WatermarkBottomLeft,
+	usersv1.WatermarkPosition_WATERMARK_POSITION_BOTTOM_RIGHT: imaging.WatermarkBottomRight,
+	usersv1.WatermarkPosition_WATERMARK_POSITION_CENTER:       imaging.WatermarkCenter,
+}
+
+// watermarkFromProto validates an API watermark for userID ("" for the
+// site-wide one)
+func watermarkFromProto(ctx context.Context, userID string, w *usersv1.Watermark) (*db.Watermark, error) {
+	if w == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("watermark is required"))
+	}
+	if (w.Text == "") == (len(w.Image) == 0) {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("set exactly one of text and image"))
+	}
+	if utf8.RuneCountInString(w.Text) > imaging.MaxWatermarkText {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("watermark text must be at most %d characters", imaging.MaxWatermarkText))
+	}
+	if len(w.Image) > 0 {
+		if _, err := imaging.DecodeWatermarkLogo(ctx, w.Image); err != nil {
+			return nil, imageProcessingError(err)
+		}
+	}
+	position, ok := watermarkPositions[w.Position]
+	if !ok {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid watermark position"))
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("opacity must be between 0 and 1"))
+	}
+	if w.Scale < imaging.MinWatermarkScale || w.Scale > 1 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("scale must be between %g and 1", imaging.MinWatermarkScale))
+	}
+
+	return &db.Watermark{
+		UserID:   userID,
+		Text:     w.Text,
+		Image:    w.Image,
+		Position: position,
+		Opacity:  float64(w.Opacity),
+		Scale:    float64(w.Scale),
+		Enabled:  w.Enabled == nil || *w.Enabled,
+	}, nil
+}
+
+// watermarkToProto converts a database watermark to its API form
+func watermarkToProto(w *db.Watermark) *usersv1.Watermark {
+	if w == nil {
+		return nil
+	}
+	position := usersv1.WatermarkPosition_WATERMARK_POSITION_BOTTOM_RIGHT
+	for pbPosition, name := range watermarkPositions {
+		if name == w.Position && pbPosition != usersv1.WatermarkPosition_WATERMARK_POSITION_UNSPECIFIED {
+			position = pbPosition
+		}
+	}
+	enabled := w.Enabled
+	return &usersv1.Watermark{
+		Text:      w.Text,
+		Image:     w.Image,
+		Position:  position,
+		Opacity:   float32(w.Opacity),
+		Scale:     float32(w.Scale),
+		Enabled:   &enabled,
+		UpdatedAt: w.UpdatedAt,
+	}
+}
+
+// watermarkFor returns the watermark to draw on ownerID's images for other
+// viewers, or nil if none applies, along with a version string that
+// changes whenever the watermark does
+func watermarkFor(ctx context.Context, ownerID string) (*imaging.Watermark, string, error) {
+	w, err := db.EffectiveWatermark(ctx, ownerID)
+	if err != nil {
+		return nil, "", connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if w == nil {
+		return nil, "", nil
+	}
+	version := w.UserID + "@" + w.UpdatedAt
+	wm := &imaging.Watermark{
+		Text:     w.Text,
+		Position: w.Position,
+		Opacity:  w.Opacity,
+		Scale:    w.Scale,
+	}
+	if len(w.Image) > 0 {
+		logo, ok := watermarkLogos.Get(version)
+		if !ok {
+			if logo, err = imaging.DecodeWatermarkLogo(ctx, w.Image); err != nil {
+				if errors.Is(err, imaging.ErrInvalidImage) || errors.Is(err, imaging.ErrImageTooLarge) {
+					return nil, "", connect.NewError(connect.CodeInternal, fmt.Errorf("invalid stored watermark: %w", err))
+				}
+				return nil, "", imageProcessingError(err)
+			}
+			b := logo.Bounds()
+			watermarkLogos.Add(version, logo, b.Dx()*b.Dy()*4)
+		}
+		wm.Logo = logo
+	}
+	return wm, version, nil
+}
+
+// watermarkedThumbnails caches watermarked thumbnails by image, thumbnail
+// content and watermark version
+var watermarkedThumbnails = newLRUCache[[]byte](16 << 20)
+
+// thumbnailWatermarks watermarks the thumbnails in a listing served to
+// viewerID, looking up each owner's watermark once per listing
+type thumbnailWatermarks struct {
+	viewerID   string
+	watermarks map[string]*imaging.Watermark
+	versions   map[string]string
+}
+
+func newThumbnailWatermarks(viewerID string) *thumbnailWatermarks {
+	return &thumbnailWatermarks{
+		viewerID:   viewerID,
+		watermarks: make(map[string]*imaging.Watermark),
+		versions:   make(map[string]string),
+	}
+}
+
+// apply replaces img's thumbnail with a watermarked one unless the viewer
+// owns the image or no watermark applies to its owner
+func (t *thumbnailWatermarks) apply(ctx context.Context, img *db.ImageInfo) error {
+	if img.OwnerID == t.viewerID || len(img.Thumbnail) == 0 {
+		return nil
+	}
+	watermark, ok := t.watermarks[img.OwnerID]
+	if !ok {
+		var version string
+		var err error
+		if watermark, version, err = watermarkFor(ctx, img.OwnerID); err != nil {
+			return err
+		}
+		t.watermarks[img.OwnerID] = watermark
+		t.versions[img.OwnerID] = version
+	}
+	if watermark == nil {
+		return nil
+	}
+
+	key := img.ID + "/" + db.ContentHash(img.Thumbnail) + "/" + t.versions[img.OwnerID]
+	rendered, ok := watermarkedThumbnails.Get(key)
+	if !ok {
+		var err error
+		if rendered, err = imaging.Render(ctx, img.Thumbnail, nil, watermark); err != nil {
+			return imageProcessingError(err)
+		}
+		watermarkedThumbnails.Add(key, rendered, len(rendered))
+	}
+	img.Thumbnail = rendered
+	return nil
+}
+
+// getWatermark, setWatermark and deleteWatermark implement the user and
+// site-wide (userID "") watermark RPCs
+func getWatermark(ctx context.Context, userID string) (*usersv1.Watermark, error) {
+	w, err := db.GetWatermark(ctx, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	return watermarkToProto(w), nil
+}
+
+func setWatermark(ctx context.Context, userID string, pb *usersv1.Watermark) (*usersv1.Watermark, error) {
+	w, err := watermarkFromProto(ctx, userID, pb)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.SetWatermark(ctx, w); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to save watermark: %w", err))
+	}
+	return getWatermark(ctx, userID)
+}
+
+func deleteWatermark(ctx context.Context, userID string) error {
+	deleted, err := db.DeleteWatermark(ctx, userID)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, fmt.Errorf("database error: %w", err))
+	}
+	if !deleted {
+		return connect.NewError(connect.CodeNotFound, errors.New("watermark not found"))
+	}
+	return nil
+}
+
+// GetWatermark returns the caller's watermark
+func (s *UserServer) GetWatermark(
+	ctx context.Context,
+	req *connect.Request[usersv1.GetWatermarkRequest],
+) (*connect.Response[usersv1.GetWatermarkResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	w, err := getWatermark(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.GetWatermarkResponse{
+		Watermark: w,
+	}), nil
+}
+
+// SetWatermark creates or replaces the caller's watermark
+func (s *UserServer) SetWatermark(
+	ctx context.Context,
+	req *connect.Request[usersv1.SetWatermarkRequest],
+) (*connect.Response[usersv1.SetWatermarkResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	w, err := setWatermark(ctx, userID, req.Msg.Watermark)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.SetWatermarkResponse{
+		Watermark: w,
+	}), nil
+}
+
+// DeleteWatermark removes the caller's watermark
+func (s *UserServer) DeleteWatermark(
+	ctx context.Context,
+	req *connect.Request[usersv1.DeleteWatermarkRequest],
+) (*connect.Response[usersv1.DeleteWatermarkResponse], error) {
+	userID := req.Header().Get("X-User-ID")
+	if userID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("authentication required"))
+	}
+
+	if err := deleteWatermark(ctx, userID); err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.DeleteWatermarkResponse{
+		Success: true,
+	}), nil
+}
+
+// GetSiteWatermark returns the site-wide watermark (admin only)
+func (s *AdminServer) GetSiteWatermark(
+	ctx context.Context,
+	req *connect.Request[usersv1.GetSiteWatermarkRequest],
+) (*connect.Response[usersv1.GetSiteWatermarkResponse], error) {
+	if err := requireAdmin(ctx, req.Header().Get("X-User-ID")); err != nil {
+		return nil, err
+	}
+
+	w, err := getWatermark(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.GetSiteWatermarkResponse{
+		Watermark: w,
+	}), nil
+}
+
+// SetSiteWatermark creates or replaces the site-wide watermark (admin only)
+func (s *AdminServer) SetSiteWatermark(
+	ctx context.Context,
+	req *connect.Request[usersv1.SetSiteWatermarkRequest],
+) (*connect.Response[usersv1.SetSiteWatermarkResponse], error) {
+	if err := requireAdmin(ctx, req.Header().Get("X-User-ID")); err != nil {
+		return nil, err
+	}
+
+	w, err := setWatermark(ctx, "", req.Msg.Watermark)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.SetSiteWatermarkResponse{
+		Watermark: w,
+	}), nil
+}
+
+// DeleteSiteWatermark removes the site-wide watermark (admin only)
+func (s *AdminServer) DeleteSiteWatermark(
+	ctx context.Context,
+	req *connect.Request[usersv1.DeleteSiteWatermarkRequest],
+) (*connect.Response[usersv1.DeleteSiteWatermarkResponse], error) {
+	if err := requireAdmin(ctx, req.Header().Get("X-User-ID")); err != nil {
+		return nil, err
+	}
+
+	if err := deleteWatermark(ctx, ""); err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&usersv1.DeleteSiteWatermarkResponse{
+		Success: true,
+	}), nil
+}
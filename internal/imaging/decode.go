@@ -0,0 +1,209 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Default decode limits, overridable through the environment (see Init)
+const (
+	defaultMaxWidth      = 12000
+	defaultMaxHeight     = 12000
+	defaultMaxMegapixels = 50
+	defaultDecodeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrInvalidImage is returned for data that cannot be decoded as an image
+	ErrInvalidImage = errors.New("invalid or unsupported image")
+	// ErrImageTooLarge is returned when the declared dimensions exceed the limits
+	ErrImageTooLarge = errors.New("image dimensions exceed limits")
+	// ErrDecodeTimeout is returned when decoding does not finish in time
+	ErrDecodeTimeout = errors.New("image decoding timed out")
+)
+
+// Limits bounds the images the decoder will accept
+type Limits struct {
+	MaxWidth      int
+	MaxHeight     int
+	MaxMegapixels float64
+}
+
+// check validates image dimensions against the limits
+func (l Limits) check(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return ErrInvalidImage
+	}
+	if width > l.MaxWidth || height > l.MaxHeight {
+		return fmt.Errorf("%w: %dx%d (max %dx%d)", ErrImageTooLarge, width, height, l.MaxWidth, l.MaxHeight)
+	}
+	if mp := float64(width) * float64(height) / 1e6; mp > l.MaxMegapixels {
+		return fmt.Errorf("%w: %.1f megapixels (max %.1f)", ErrImageTooLarge, mp, l.MaxMegapixels)
+	}
+	return nil
+}
+
+// Decoder decodes untrusted images with dimension checks, a bounded number
+// of concurrent decodes and a per-decode timeout
+type Decoder struct {
+	limits  Limits
+	timeout time.Duration
+	workers chan struct{}
+}
+
+// NewDecoder creates a decoder allowing at most workers concurrent decodes
+func NewDecoder(limits Limits, workers int, timeout time.Duration) *Decoder {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &Decoder{
+		limits:  limits,
+		timeout: timeout,
+		workers: make(chan struct{}, workers),
+	}
+}
+
+// std is the shared decoder used by the package-level helpers
+var std = NewDecoder(Limits{
+	MaxWidth:      defaultMaxWidth,
+	MaxHeight:     defaultMaxHeight,
+	MaxMegapixels: defaultMaxMegapixels,
+}, runtime.NumCPU(), defaultDecodeTimeout)
+
+// Init configures the shared decoder from the environment:
+// IMAGE_MAX_WIDTH, IMAGE_MAX_HEIGHT, IMAGE_MAX_MEGAPIXELS,
+// IMAGE_DECODE_WORKERS and IMAGE_DECODE_TIMEOUT (a Go duration).
+func Init() error {
+	limits := std.limits
+	workers := cap(std.workers)
+	timeout := std.timeout
+
+	var err error
+	if v := os.Getenv("IMAGE_MAX_WIDTH"); v != "" {
+		if limits.MaxWidth, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid IMAGE_MAX_WIDTH: %w", err)
+		}
+	}
+	if v := os.Getenv("IMAGE_MAX_HEIGHT"); v != "" {
+		if limits.MaxHeight, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid IMAGE_MAX_HEIGHT: %w", err)
+		}
+	}
+	if v := os.Getenv("IMAGE_MAX_MEGAPIXELS"); v != "" {
+		if limits.MaxMegapixels, err = strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("invalid IMAGE_MAX_MEGAPIXELS: %w", err)
+		}
+	}
+	if v := os.Getenv("IMAGE_DECODE_WORKERS"); v != "" {
+		if workers, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid IMAGE_DECODE_WORKERS: %w", err)
+		}
+	}
+	if v := os.Getenv("IMAGE_DECODE_TIMEOUT"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid IMAGE_DECODE_TIMEOUT: %w", err)
+		}
+	}
+
+	std = NewDecoder(limits, workers, timeout)
+	return nil
+}
+
+// Validate checks an image's header against the shared decoder's limits
+// without decoding pixel data
+func Validate(data []byte) (image.Config, string, error) {
+	return std.Validate(data)
+}
+
+// Decode decodes an image with the shared decoder. See Decoder.Decode.
+func Decode(ctx context.Context, data []byte) (image.Image, error) {
+	return std.Decode(ctx, data)
+}
+
+// Validate reads only the image header and checks the declared dimensions
+// against the limits
+func (d *Decoder) Validate(data []byte) (image.Config, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return cfg, "", fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if err := d.limits.check(cfg.Width, cfg.Height); err != nil {
+		return cfg, "", err
+	}
+	return cfg, format, nil
+}
+
+// Decode validates the image header, then decodes the pixels on one of the
+// decoder's workers and applies the Exif orientation so the result is
+// upright. All derived images (thumbnails, renditions) should be produced
+// from this rather than image.Decode. It returns ErrDecodeTimeout if the
+// decode doesn't finish in time, or ctx's error if ctx ends first.
+func (d *Decoder) Decode(ctx context.Context, data []byte) (image.Image, error) {
+	if _, _, err := d.Validate(data); err != nil {
+		return nil, err
+	}
+
+	var img image.Image
+	err := d.run(ctx, func() (err error) {
+		img, err = decodeUpright(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// decodeUpright decodes validated image data and applies its Exif
+// orientation. It must only be called on one of a decoder's workers.
+func decodeUpright(data []byte) (image.Image, error) {
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	return applyOrientation(decoded, Orientation(data)), nil
+}
+
+// run calls fn on one of the decoder's workers, so that fn's memory use
+// counts against the decoder's bound. It returns fn's error,
+// ErrDecodeTimeout if fn doesn't finish within the decoder's timeout, or
+// ctx's error if ctx ends first. fn's results must only be read after run
+// returns nil.
+func (d *Decoder) run(parent context.Context, fn func() error) error {
+	ctx, cancel := context.WithTimeout(parent, d.timeout)
+	defer cancel()
+	stopped := func() error {
+		if err := parent.Err(); err != nil {
+			return err
+		}
+		return ErrDecodeTimeout
+	}
+
+	select {
+	case d.workers <- struct{}{}:
+	case <-ctx.Done():
+		return stopped()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// The worker slot is held until fn actually finishes, even if the
+		// caller has given up, so abandoned work still counts
+		defer func() { <-d.workers }()
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return stopped()
+	}
+}
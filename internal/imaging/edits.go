@@ -0,0 +1,242 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// Edit operations
+const (
+	EditCrop       = "crop"
+	EditRotate     = "rotate"
+	EditFlip       = "flip"
+	EditBrightness = "brightness"
+	EditContrast   = "contrast"
+	EditSaturation = "saturation"
+	EditGrayscale  = "grayscale"
+)
+
+// MaxEdits caps the length of an edit recipe
+const MaxEdits = 50
+
+// rotateOrientations maps clockwise rotations to the equivalent Exif
+// orientation
+var rotateOrientations = map[int]int{90: 6, 180: 3, 270: 8}
+
+// ErrInvalidEdit is returned for edits that are malformed or don't fit the
+// image they are applied to
+var ErrInvalidEdit = errors.New("invalid edit")
+
+// Edit is one step of a non-destructive edit recipe. Recipes are stored as
+// JSON and applied in order over the upright original whenever the image
+// is rendered, so the original is never modified.
+type Edit struct {
+	Op string `json:"op"`
+	// Crop rectangle, in pixels of the image produced by the preceding edits
+	X      int `json:"x,omitempty"`
+	Y      int `json:"y,omitempty"`
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Degrees to rotate clockwise: 90, 180 or 270
+	Degrees int `json:"degrees,omitempty"`
+	// Vertical flips top to bottom instead of left to right
+	Vertical bool `json:"vertical,omitempty"`
+	// Amount adjusts brightness, contrast or saturation, from -1 to 1;
+	// 0 leaves the image unchanged and -1 saturation is grayscale
+	Amount float64 `json:"amount,omitempty"`
+}
+
+// EditedSize checks a recipe against an upright image of the given size and
+// returns the size of the result
+func EditedSize(width, height int, edits []Edit) (int, int, error) {
+	if len(edits) > MaxEdits {
+		return 0, 0, fmt.Errorf("%w: at most %d edits", ErrInvalidEdit, MaxEdits)
+	}
+	for i, e := range edits {
+		switch e.Op {
+		case EditCrop:
+			if e.Width <= 0 || e.Height <= 0 || e.X < 0 || e.Y < 0 ||
+				e.X+e.Width > width || e.Y+e.Height > height {
+				return 0, 0, fmt.Errorf("%w: edit %d: crop must lie within the %dx%d image", ErrInvalidEdit, i+1, width, height)
+			}
+			width, height = e.Width, e.Height
+		case EditRotate:
+			switch e.Degrees {
+			case 90, 270:
+				width, height = height, width
+			case 180:
+			default:
+				return 0, 0, fmt.Errorf("%w: edit %d: rotation must be 90, 180 or 270 degrees", ErrInvalidEdit, i+1)
+			}
+		case EditBrightness, EditContrast, EditSaturation:
+			if e.Amount < -1 || e.Amount > 1 {
+				return 0, 0, fmt.Errorf("%w: edit %d: amount must be between -1 and 1", ErrInvalidEdit, i+1)
+			}
+		case EditFlip, EditGrayscale:
+		default:
+			return 0, 0, fmt.Errorf("%w: edit %d: unknown operation %q", ErrInvalidEdit, i+1, e.Op)
+		}
+	}
+	return width, height, nil
+}
+
+// ApplyEdits runs a recipe over an upright image
+func ApplyEdits(img image.Image, edits []Edit) (image.Image, error) {
+	b := img.Bounds()
+	if _, _, err := EditedSize(b.Dx(), b.Dy(), edits); err != nil {
+		return nil, err
+	}
+	for _, e := range edits {
+		switch e.Op {
+		case EditCrop:
+			b := img.Bounds()
+			cropped := image.NewRGBA(image.Rect(0, 0, e.Width, e.Height))
+			draw.Copy(cropped, image.Point{}, img, image.Rect(b.Min.X+e.X, b.Min.Y+e.Y, b.Min.X+e.X+e.Width, b.Min.Y+e.Y+e.Height), draw.Src, nil)
+			img = cropped
+		case EditRotate:
+			img = applyOrientation(img, rotateOrientations[e.Degrees])
+		case EditFlip:
+			if e.Vertical {
+				img = applyOrientation(img, 4)
+			} else {
+				img = applyOrientation(img, 2)
+			}
+		case EditBrightness:
+			offset := e.Amount * 255
+			img = mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				return r + offset, g + offset, b + offset
+			})
+		case EditContrast:
+			factor := 1 + e.Amount
+			img = mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				return (r-128)*factor + 128, (g-128)*factor + 128, (b-128)*factor + 128
+			})
+		case EditSaturation:
+			factor := 1 + e.Amount
+			img = mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				l := luma(r, g, b)
+				return l + (r-l)*factor, l + (g-l)*factor, l + (b-l)*factor
+			})
+		case EditGrayscale:
+			img = mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+				l := luma(r, g, b)
+				return l, l, l
+			})
+		}
+	}
+	return img, nil
+}
+
+// Render renders a JPEG with the shared decoder. See Decoder.Render.
+func Render(ctx context.Context, data []byte, edits []Edit, watermark *Watermark) ([]byte, error) {
+	return std.Render(ctx, data, edits, watermark)
+}
+
+// Render decodes a JPEG, applies an edit recipe and then the watermark (if
+// not nil), and re-encodes the result with the original's metadata minus
+// anything that could preview the unedited image. The whole pipeline runs
+// on one of the decoder's workers and within its timeout, since editing
+// and encoding take as much memory as decoding.
+func (d *Decoder) Render(ctx context.Context, data []byte, edits []Edit, watermark *Watermark) ([]byte, error) {
+	if _, _, err := d.Validate(data); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	err := d.run(ctx, func() error {
+		img, err := decodeUpright(data)
+		if err != nil {
+			return err
+		}
+		rendered, err := ApplyEdits(img, edits)
+		if err != nil {
+			return err
+		}
+		if watermark != nil {
+			rendered = applyWatermark(rendered, watermark)
+		}
+		out, err = reencodeRendition(data, rendered)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// iccHeader prefixes APP2 segments holding an ICC color profile
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// reencodeRendition encodes a rendered image with metadata derived from its
+// JPEG original. Unlike reencode it keeps nothing that could preview the
+// original: only JFIF, ICC profiles and comments are copied, and Exif is
+// rebuilt by renderedExif without IFD1. XMP, Photoshop (APP13) and MPF
+// segments, which can all embed the unedited image, are dropped.
+func reencodeRendition(original []byte, img image.Image) ([]byte, error) {
+	originalSegments, _, err := splitSegments(original)
+	if err != nil {
+		return nil, err
+	}
+	encoded, scan, err := encodeJPEG(img)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	var segments []segment
+	for _, s := range originalSegments {
+		switch {
+		case s.Marker == markerCOM, s.Marker == markerAPP0:
+		case s.Marker == markerAPP2 && bytes.HasPrefix(s.Data, iccHeader):
+		case s.isExif():
+			t, err := parseTIFF(s.Data)
+			if err != nil {
+				continue
+			}
+			s.Data = renderedExif(t, b.Dx(), b.Dy())
+			if len(s.Data) > maxSegmentSize {
+				s.Data = minimalExif(1)
+			}
+		default:
+			continue
+		}
+		segments = append(segments, s)
+	}
+	return joinSegments(append(segments, encoded...), scan), nil
+}
+
+// luma returns the Rec. 601 brightness of an 8-bit color
+func luma(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+// mapColors returns a copy of img with f applied to every pixel's 8-bit
+// color channels, clamping the results. Alpha is kept.
+func mapColors(img image.Image, f func(r, g, b float64) (float64, float64, float64)) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Copy(dst, image.Point{}, img, b, draw.Src, nil)
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		r, g, bl := f(float64(dst.Pix[i]), float64(dst.Pix[i+1]), float64(dst.Pix[i+2]))
+		dst.Pix[i] = clamp8(r)
+		dst.Pix[i+1] = clamp8(g)
+		dst.Pix[i+2] = clamp8(bl)
+	}
+	return dst
+}
+
+// clamp8 rounds v to the nearest 8-bit channel value
+func clamp8(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,394 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Exif tags used by this package
+const (
+	tagOrientation = 0x0112
+	tagGPSInfo     = 0x8825
+)
+
+var errBadExif = errors.New("malformed Exif data")
+
+// tiff wraps the TIFF structure embedded in an Exif APP1 segment
+type tiff struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+// parseTIFF parses the header of an Exif APP1 payload (including the
+// "Exif\0\0" prefix). The returned tiff aliases the payload.
+func parseTIFF(payload []byte) (*tiff, error) {
+	buf := payload[len(exifHeader):]
+	if len(buf) < 8 {
+		return nil, errBadExif
+	}
+
+	t := &tiff{buf: buf}
+	switch string(buf[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errBadExif
+	}
+	if t.order.Uint16(buf[2:]) != 42 {
+		return nil, errBadExif
+	}
+	return t, nil
+}
+
+// ifd0 returns the offset of the first image file directory
+func (t *tiff) ifd0() int {
+	return int(t.order.Uint32(t.buf[4:]))
+}
+
+// entryCount returns the number of entries in the IFD at offset
+func (t *tiff) entryCount(ifd int) (int, error) {
+	if ifd < 8 || ifd+2 > len(t.buf) {
+		return 0, errBadExif
+	}
+	n := int(t.order.Uint16(t.buf[ifd:]))
+	if ifd+2+n*12+4 > len(t.buf) {
+		return 0, errBadExif
+	}
+	return n, nil
+}
+
+// findEntry returns the position of the 12-byte entry for tag in the IFD at
+// offset, or -1 if the tag is not present
+func (t *tiff) findEntry(ifd int, tag uint16) (int, error) {
+	n, err := t.entryCount(ifd)
+	if err != nil {
+		return -1, err
+	}
+	for i := 0; i < n; i++ {
+		pos := ifd + 2 + i*12
+		if t.order.Uint16(t.buf[pos:]) == tag {
+			return pos, nil
+		}
+	}
+	return -1, nil
+}
+
+// valueSize returns the byte size of an entry's value
+func (t *tiff) valueSize(pos int) int {
+	var unit int
+	switch t.order.Uint16(t.buf[pos+2:]) {
+	case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+		unit = 1
+	case 3, 8: // SHORT, SSHORT
+		unit = 2
+	case 4, 9, 11: // LONG, SLONG, FLOAT
+		unit = 4
+	case 5, 10, 12: // RATIONAL, SRATIONAL, DOUBLE
+		unit = 8
+	default:
+		return 0
+	}
+	return unit * int(t.order.Uint32(t.buf[pos+4:]))
+}
+
+// removeEntry deletes the entry at pos from the IFD at offset, shifting the
+// remaining entries and the next-IFD pointer down and zeroing the freed bytes
+func (t *tiff) removeEntry(ifd, pos int) error {
+	n, err := t.entryCount(ifd)
+	if err != nil {
+		return err
+	}
+	end := ifd + 2 + n*12 + 4
+	copy(t.buf[pos:], t.buf[pos+12:end])
+	clear(t.buf[end-12 : end])
+	t.order.PutUint16(t.buf[ifd:], uint16(n-1))
+	return nil
+}
+
+// removeGPS wipes the GPS IFD and unlinks it from IFD0. It reports whether
+// any GPS data was present.
+func (t *tiff) removeGPS() (bool, error) {
+	ifd0 := t.ifd0()
+	pos, err := t.findEntry(ifd0, tagGPSInfo)
+	if err != nil || pos < 0 {
+		return false, err
+	}
+
+	gps := int(t.order.Uint32(t.buf[pos+8:]))
+	if n, err := t.entryCount(gps); err == nil {
+		// Zero out-of-line values first, then the directory itself
+		for i := 0; i < n; i++ {
+			entry := gps + 2 + i*12
+			size := t.valueSize(entry)
+			if size <= 4 {
+				continue
+			}
+			off := int(t.order.Uint32(t.buf[entry+8:]))
+			if off >= 8 && off+size <= len(t.buf) {
+				clear(t.buf[off : off+size])
+			}
+		}
+		clear(t.buf[gps : gps+2+n*12+4])
+	}
+
+	return true, t.removeEntry(ifd0, pos)
+}
+
+// orientation returns the Orientation tag from IFD0, or 1 if absent
+func (t *tiff) orientation() int {
+	pos, err := t.findEntry(t.ifd0(), tagOrientation)
+	if err != nil || pos < 0 {
+		return 1
+	}
+	return int(t.order.Uint16(t.buf[pos+8:]))
+}
+
+// setOrientation overwrites the Orientation tag in place. It is a no-op if
+// the tag is absent.
+func (t *tiff) setOrientation(o int) {
+	pos, err := t.findEntry(t.ifd0(), tagOrientation)
+	if err != nil || pos < 0 {
+		return
+	}
+	t.order.PutUint16(t.buf[pos+8:], uint16(o))
+}
+
+// minimalExif builds an Exif APP1 payload containing only an Orientation tag
+func minimalExif(o int) []byte {
+	buf := make([]byte, 0, len(exifHeader)+26)
+	buf = append(buf, exifHeader...)
+	buf = append(buf, 'M', 'M', 0, 42, 0, 0, 0, 8) // big-endian header, IFD0 at 8
+	buf = append(buf, 0, 1)                        // one entry
+	buf = append(buf, tagOrientation>>8, tagOrientation&0xFF, 0, 3, 0, 0, 0, 1, 0, byte(o), 0, 0)
+	return append(buf, 0, 0, 0, 0) // no next IFD
+}
+
+// Tags kept when rebuilding the Exif data of a rendered image: descriptive
+// fields that stay true of an edited image. Anything that could hold a
+// preview of the original (IFD1, MakerNote) or describe its old geometry
+// is left out.
+var (
+	renderedIFD0Tags = map[uint16]bool{
+		0x010E: true, // ImageDescription
+		0x010F: true, // Make
+		0x0110: true, // Model
+		0x0131: true, // Software
+		0x0132: true, // DateTime
+		0x013B: true, // Artist
+		0x8298: true, // Copyright
+	}
+	renderedExifTags = map[uint16]bool{
+		0x829A: true, // ExposureTime
+		0x829D: true, // FNumber
+		0x8822: true, // ExposureProgram
+		0x8827: true, // ISOSpeedRatings
+		0x9000: true, // ExifVersion
+		0x9003: true, // DateTimeOriginal
+		0x9004: true, // DateTimeDigitized
+		0x9010: true, // OffsetTime
+		0x9011: true, // OffsetTimeOriginal
+		0x9012: true, // OffsetTimeDigitized
+		0x9201: true, // ShutterSpeedValue
+		0x9202: true, // ApertureValue
+		0x9204: true, // ExposureBiasValue
+		0x9207: true, // MeteringMode
+		0x9209: true, // Flash
+		0x920A: true, // FocalLength
+		0xA001: true, // ColorSpace
+		0xA405: true, // FocalLengthIn35mmFilm
+		0xA433: true, // LensMake
+		0xA434: true, // LensModel
+	}
+)
+
+// More Exif tags used when rebuilding Exif data
+const (
+	tagExifIFD         = 0x8769
+	tagPixelXDimension = 0xA002
+	tagPixelYDimension = 0xA003
+)
+
+// TIFF field types written by this package
+const (
+	tiffShort = 3
+	tiffLong  = 4
+)
+
+// tiffEntry is an IFD entry with its value bytes, in the byte order of the
+// tiff it belongs to
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// entries copies the entries of the IFD at offset for which keep returns
+// true, skipping any whose value lies outside the data
+func (t *tiff) entries(ifd int, keep func(tag uint16) bool) []tiffEntry {
+	n, err := t.entryCount(ifd)
+	if err != nil {
+		return nil
+	}
+	var entries []tiffEntry
+	for i := 0; i < n; i++ {
+		pos := ifd + 2 + i*12
+		tag := t.order.Uint16(t.buf[pos:])
+		size := t.valueSize(pos)
+		if !keep(tag) || size == 0 {
+			continue
+		}
+		value := t.buf[pos+8 : pos+8+min(size, 4)]
+		if size > 4 {
+			off := int(t.order.Uint32(t.buf[pos+8:]))
+			if off < 8 || off+size > len(t.buf) {
+				continue
+			}
+			value = t.buf[off : off+size]
+		}
+		entries = append(entries, tiffEntry{
+			tag:   tag,
+			typ:   t.order.Uint16(t.buf[pos+2:]),
+			count: t.order.Uint32(t.buf[pos+4:]),
+			value: value,
+		})
+	}
+	return entries
+}
+
+// subIFD returns the offset of the IFD pointed to by tag in IFD0, or -1
+func (t *tiff) subIFD(tag uint16) int {
+	pos, err := t.findEntry(t.ifd0(), tag)
+	if err != nil || pos < 0 {
+		return -1
+	}
+	return int(t.order.Uint32(t.buf[pos+8:]))
+}
+
+// renderedExif rebuilds an Exif APP1 payload for an image rendered from
+// the original described by t, width x height pixels and upright. Only the
+// descriptive tags above and the GPS directory are carried over; there is
+// no IFD1, so no thumbnail of the original survives.
+func renderedExif(t *tiff, width, height int) []byte {
+	keepAll := func(uint16) bool { return true }
+	ifd0 := t.entries(t.ifd0(), func(tag uint16) bool { return renderedIFD0Tags[tag] })
+	ifd0 = append(ifd0, t.shortEntry(tagOrientation, 1))
+
+	var exif []tiffEntry
+	if off := t.subIFD(tagExifIFD); off >= 0 {
+		exif = t.entries(off, func(tag uint16) bool { return renderedExifTags[tag] })
+	}
+	exif = append(exif, t.longEntry(tagPixelXDimension, uint32(width)), t.longEntry(tagPixelYDimension, uint32(height)))
+
+	var gps []tiffEntry
+	if off := t.subIFD(tagGPSInfo); off >= 0 {
+		gps = t.entries(off, keepAll)
+	}
+
+	// Pointer values are filled in once the directory sizes are known
+	ifd0 = append(ifd0, t.longEntry(tagExifIFD, 0))
+	if len(gps) > 0 {
+		ifd0 = append(ifd0, t.longEntry(tagGPSInfo, 0))
+	}
+	sortEntries(ifd0)
+	sortEntries(exif)
+	sortEntries(gps)
+
+	exifAt := 8 + ifdSize(ifd0)
+	gpsAt := exifAt + ifdSize(exif)
+	for i := range ifd0 {
+		switch ifd0[i].tag {
+		case tagExifIFD:
+			t.order.PutUint32(ifd0[i].value, uint32(exifAt))
+		case tagGPSInfo:
+			t.order.PutUint32(ifd0[i].value, uint32(gpsAt))
+		}
+	}
+
+	buf := make([]byte, 0, len(exifHeader)+gpsAt+ifdSize(gps))
+	buf = append(buf, exifHeader...)
+	if t.order == binary.LittleEndian {
+		buf = append(buf, 'I', 'I')
+	} else {
+		buf = append(buf, 'M', 'M')
+	}
+	buf = t.append16(buf, 42)
+	buf = t.append32(buf, 8)
+	buf = t.appendIFD(buf, ifd0, 8)
+	buf = t.appendIFD(buf, exif, exifAt)
+	if len(gps) > 0 {
+		buf = t.appendIFD(buf, gps, gpsAt)
+	}
+	return buf
+}
+
+// shortEntry and longEntry build single-value entries in t's byte order
+func (t *tiff) shortEntry(tag uint16, v uint16) tiffEntry {
+	return tiffEntry{tag: tag, typ: tiffShort, count: 1, value: t.append16(nil, v)}
+}
+
+func (t *tiff) longEntry(tag uint16, v uint32) tiffEntry {
+	return tiffEntry{tag: tag, typ: tiffLong, count: 1, value: t.append32(nil, v)}
+}
+
+// append16 and append32 append a value to buf in t's byte order
+func (t *tiff) append16(buf []byte, v uint16) []byte {
+	var b [2]byte
+	t.order.PutUint16(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func (t *tiff) append32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	t.order.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// sortEntries puts entries in ascending tag order, as TIFF requires
+func sortEntries(entries []tiffEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+}
+
+// ifdSize returns the bytes an IFD and its out-of-line values take up
+func ifdSize(entries []tiffEntry) int {
+	size := 2 + len(entries)*12 + 4
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += len(e.value) + len(e.value)%2
+		}
+	}
+	return size
+}
+
+// appendIFD appends an IFD starting at TIFF offset at, followed by its
+// out-of-line values (word aligned), with no next IFD
+func (t *tiff) appendIFD(buf []byte, entries []tiffEntry, at int) []byte {
+	buf = t.append16(buf, uint16(len(entries)))
+	data := at + 2 + len(entries)*12 + 4
+	for _, e := range entries {
+		buf = t.append16(buf, e.tag)
+		buf = t.append16(buf, e.typ)
+		buf = t.append32(buf, e.count)
+		if len(e.value) > 4 {
+			buf = t.append32(buf, uint32(data))
+			data += len(e.value) + len(e.value)%2
+			continue
+		}
+		var inline [4]byte
+		copy(inline[:], e.value)
+		buf = append(buf, inline[:]...)
+	}
+	buf = t.append32(buf, 0)
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			buf = append(buf, e.value...)
+			if len(e.value)%2 == 1 {
+				buf = append(buf, 0)
+			}
+		}
+	}
+	return buf
+}
@@ -0,0 +1,114 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+)
+
+// JPEG marker bytes (the byte following 0xFF)
+const (
+	markerSOI   = 0xD8
+	markerEOI   = 0xD9
+	markerSOS   = 0xDA
+	markerAPP0  = 0xE0
+	markerAPP1  = 0xE1
+	markerAPP2  = 0xE2
+	markerAPP14 = 0xEE
+	markerAPP15 = 0xEF
+	markerCOM   = 0xFE
+)
+
+// maxSegmentSize is the largest payload a marker segment can hold
+const maxSegmentSize = 0xFFFF - 2
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// ErrNotJPEG is returned when the input does not start with a JPEG SOI marker
+var ErrNotJPEG = errors.New("not a JPEG image")
+
+// segment is a single marker segment from the JPEG header section.
+// Data holds the payload without the marker and the two length bytes.
+type segment struct {
+	Marker byte
+	Data   []byte
+}
+
+// isAPP reports whether the segment is an application (APPn) segment
+func (s segment) isAPP() bool {
+	return s.Marker >= markerAPP0 && s.Marker <= markerAPP15
+}
+
+// isExif reports whether the segment is an APP1 Exif block
+func (s segment) isExif() bool {
+	return s.Marker == markerAPP1 && bytes.HasPrefix(s.Data, exifHeader)
+}
+
+// isXMP reports whether the segment is an APP1 XMP packet
+func (s segment) isXMP() bool {
+	return s.Marker == markerAPP1 && bytes.HasPrefix(s.Data, xmpHeader)
+}
+
+// splitSegments parses the header segments of a JPEG file up to (but not
+// including) the start-of-scan marker. The returned scan slice contains
+// everything from the SOS marker to the end of the file, untouched.
+func splitSegments(data []byte) ([]segment, []byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, nil, ErrNotJPEG
+	}
+
+	var segments []segment
+	pos := 2
+	for pos < len(data) {
+		if data[pos] != 0xFF {
+			return nil, nil, errors.New("malformed JPEG: expected marker")
+		}
+		// Skip fill bytes
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			break
+		}
+		marker := data[pos]
+		pos++
+
+		if marker == markerSOS || marker == markerEOI {
+			return segments, data[pos-2:], nil
+		}
+		// Standalone markers carry no payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+
+		if pos+2 > len(data) {
+			return nil, nil, errors.New("malformed JPEG: truncated segment length")
+		}
+		length := int(data[pos])<<8 | int(data[pos+1])
+		if length < 2 || pos+length > len(data) {
+			return nil, nil, errors.New("malformed JPEG: invalid segment length")
+		}
+		segments = append(segments, segment{Marker: marker, Data: data[pos+2 : pos+length]})
+		pos += length
+	}
+	return nil, nil, errors.New("malformed JPEG: missing start of scan")
+}
+
+// joinSegments reassembles a JPEG file from its header segments and scan data
+func joinSegments(segments []segment, scan []byte) []byte {
+	size := 2 + len(scan)
+	for _, s := range segments {
+		size += 4 + len(s.Data)
+	}
+
+	out := make([]byte, 0, size)
+	out = append(out, 0xFF, markerSOI)
+	for _, s := range segments {
+		length := len(s.Data) + 2
+		out = append(out, 0xFF, s.Marker, byte(length>>8), byte(length))
+		out = append(out, s.Data...)
+	}
+	return append(out, scan...)
+}
@@ -0,0 +1,142 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// normalizeQuality is the JPEG quality used when re-encoding an original
+const normalizeQuality = 92
+
+// Orientation returns the Exif Orientation (1-8) of a JPEG, or 1 when the
+// image carries no usable orientation
+func Orientation(data []byte) int {
+	segments, _, err := splitSegments(data)
+	if err != nil {
+		return 1
+	}
+	for _, s := range segments {
+		if !s.isExif() {
+			continue
+		}
+		t, err := parseTIFF(s.Data)
+		if err != nil {
+			return 1
+		}
+		if o := t.orientation(); o >= 1 && o <= 8 {
+			return o
+		}
+		return 1
+	}
+	return 1
+}
+
+// applyOrientation transforms img so that it displays upright for the given
+// Exif orientation value. Upright images are returned as they are.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+// NormalizeOrientation re-encodes a JPEG so its pixels are stored upright
+// and its Orientation tag is 1. Metadata segments from the original are
+// carried over. Images that are already upright are returned unchanged.
+func NormalizeOrientation(ctx context.Context, data []byte) ([]byte, error) {
+	o := Orientation(data)
+	if o == 1 {
+		return data, nil
+	}
+
+	img, err := Decode(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	return reencode(data, img)
+}
+
+// reencode encodes upright pixels derived from the JPEG original, carrying
+// over the original's metadata segments with the Orientation tag reset to 1
+func reencode(original []byte, img image.Image) ([]byte, error) {
+	originalSegments, _, err := splitSegments(original)
+	if err != nil {
+		return nil, err
+	}
+	encoded, scan, err := encodeJPEG(img)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep metadata and color profiles, but not APP14 (Adobe), which
+	// describes the color transform of the old encoding
+	var segments []segment
+	for _, s := range originalSegments {
+		switch {
+		case s.Marker == markerCOM:
+		case s.isAPP() && s.Marker != markerAPP14:
+		default:
+			continue
+		}
+		if s.isExif() {
+			payload := append([]byte(nil), s.Data...)
+			if t, err := parseTIFF(payload); err == nil {
+				t.setOrientation(1)
+			}
+			s.Data = payload
+		}
+		segments = append(segments, s)
+	}
+	return joinSegments(append(segments, encoded...), scan), nil
+}
+
+// encodeJPEG encodes img and splits the result into its header segments
+// and scan data
+func encodeJPEG(img image.Image) ([]segment, []byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: normalizeQuality}); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return splitSegments(buf.Bytes())
+}
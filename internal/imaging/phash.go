@@ -0,0 +1,34 @@
+package imaging
+
+import (
+	"image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// DHash computes a 64-bit difference hash of img. The image is reduced to a
+// 9x8 grayscale grid and each bit records whether a cell is brighter than
+// its right-hand neighbour, so the hash survives resizing, recompression and
+// small color changes. img should be upright (see Decode).
+func DHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.CatmullRom.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := small.Pix[y*small.Stride:]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x] > row[x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance returns the number of bits that differ between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
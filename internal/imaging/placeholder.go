@@ -0,0 +1,296 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Placeholder settings
+const (
+	blurHashComponentsX = 4
+	blurHashComponentsY = 3
+	blurHashSampleSize  = 32 // pixels on the longer side sampled for the BlurHash
+	lqipSize            = 16 // pixels on the longer side of the LQIP
+	lqipQuality         = 40
+	paletteSampleSize   = 64
+	paletteIterations   = 10
+
+	// PaletteSize is the number of colors Palette returns at most
+	PaletteSize = 5
+)
+
+// Dominant color names used for filtering (stored as-is in the database)
+const (
+	ColorBlack  = "black"
+	ColorGray   = "gray"
+	ColorWhite  = "white"
+	ColorRed    = "red"
+	ColorOrange = "orange"
+	ColorBrown  = "brown"
+	ColorYellow = "yellow"
+	ColorGreen  = "green"
+	ColorBlue   = "blue"
+	ColorPurple = "purple"
+	ColorPink   = "pink"
+)
+
+// shrink scales img so its longer side is at most size pixels
+func shrink(img image.Image, size int, scaler draw.Scaler) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w >= h && w > size {
+		w, h = size, max(1, h*size/w)
+	} else if h > w && h > size {
+		w, h = max(1, w*size/h), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	scaler.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// BlurHash encodes a compact blurred placeholder of img (see blurha.sh)
+func BlurHash(img image.Image) string {
+	small := shrink(img, blurHashSampleSize, draw.ApproxBiLinear)
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+
+	factors := make([][3]float64, 0, blurHashComponentsX*blurHashComponentsY)
+	for j := 0; j < blurHashComponentsY; j++ {
+		for i := 0; i < blurHashComponentsX; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := small.Pix[small.PixOffset(x, y):]
+					f[0] += basis * srgbToLinear(p[0])
+					f[1] += basis * srgbToLinear(p[1])
+					f[2] += basis * srgbToLinear(p[2])
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encode83(&sb, (blurHashComponentsX-1)+(blurHashComponentsY-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		encode83(&sb, quantisedMax, 1)
+	} else {
+		encode83(&sb, 0, 1)
+	}
+
+	encode83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		encode83(&sb, q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return sb.String()
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encode83 appends value as length base-83 digits
+func encode83(sb *strings.Builder, value, length int) {
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+	for ; divisor > 0; divisor /= 83 {
+		sb.WriteByte(base83Chars[(value/divisor)%83])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// LQIP returns a tiny, heavily compressed JPEG of img as a data URI, for
+// display (blurred by the client) while the thumbnail loads
+func LQIP(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, shrink(img, lqipSize, draw.CatmullRom), &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return "", fmt.Errorf("failed to encode placeholder: %w", err)
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Palette returns up to PaletteSize dominant colors of img, most common
+// first, found by k-means clustering of a downscaled copy's pixels
+func Palette(img image.Image) []color.RGBA {
+	small := shrink(img, paletteSampleSize, draw.ApproxBiLinear)
+	pixels := make([][3]float64, 0, len(small.Pix)/4)
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		pixels = append(pixels, [3]float64{float64(small.Pix[i]), float64(small.Pix[i+1]), float64(small.Pix[i+2])})
+	}
+	k := min(PaletteSize, len(pixels))
+	if k == 0 {
+		return nil
+	}
+
+	// Seed deterministically with pixels spread across the brightness range
+	byLuma := append([][3]float64(nil), pixels...)
+	sort.Slice(byLuma, func(a, b int) bool {
+		return luma(byLuma[a][0], byLuma[a][1], byLuma[a][2]) < luma(byLuma[b][0], byLuma[b][1], byLuma[b][2])
+	})
+	centers := make([][3]float64, k)
+	for c := range centers {
+		centers[c] = byLuma[(2*c+1)*len(byLuma)/(2*k)]
+	}
+
+	counts := make([]int, k)
+	assign := make([]int, len(pixels))
+	for iter := 0; iter < paletteIterations; iter++ {
+		changed := false
+		for p, px := range pixels {
+			best, bestDist := 0, math.Inf(1)
+			for c, center := range centers {
+				dr, dg, db := px[0]-center[0], px[1]-center[1], px[2]-center[2]
+				if d := dr*dr + dg*dg + db*db; d < bestDist {
+					best, bestDist = c, d
+				}
+			}
+			if assign[p] != best || iter == 0 {
+				changed = true
+			}
+			assign[p] = best
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([][3]float64, k)
+		for c := range counts {
+			counts[c] = 0
+		}
+		for p, px := range pixels {
+			c := assign[p]
+			counts[c]++
+			sums[c][0] += px[0]
+			sums[c][1] += px[1]
+			sums[c][2] += px[2]
+		}
+		for c := range centers {
+			if counts[c] > 0 {
+				n := float64(counts[c])
+				centers[c] = [3]float64{sums[c][0] / n, sums[c][1] / n, sums[c][2] / n}
+			}
+		}
+	}
+
+	order := make([]int, 0, k)
+	for c := range centers {
+		if counts[c] > 0 {
+			order = append(order, c)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return counts[order[a]] > counts[order[b]] })
+
+	palette := make([]color.RGBA, 0, len(order))
+	for _, c := range order {
+		palette = append(palette, color.RGBA{clamp8(centers[c][0]), clamp8(centers[c][1]), clamp8(centers[c][2]), 255})
+	}
+	return palette
+}
+
+// HexColor formats a color as #rrggbb
+func HexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// ColorName buckets a color into one of the Color names by hue, saturation
+// and brightness
+func ColorName(c color.RGBA) string {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	v := math.Max(r, math.Max(g, b))
+	chroma := v - math.Min(r, math.Min(g, b))
+	s := 0.0
+	if v > 0 {
+		s = chroma / v
+	}
+
+	switch {
+	case v < 0.2:
+		return ColorBlack
+	case s < 0.15 && v > 0.85:
+		return ColorWhite
+	case s < 0.15:
+		return ColorGray
+	}
+
+	var hue float64
+	switch v {
+	case r:
+		hue = math.Mod((g-b)/chroma, 6)
+	case g:
+		hue = (b-r)/chroma + 2
+	default:
+		hue = (r-g)/chroma + 4
+	}
+	hue *= 60
+	if hue < 0 {
+		hue += 360
+	}
+
+	switch {
+	case hue < 15 || hue >= 345:
+		if v < 0.6 {
+			return ColorBrown
+		}
+		return ColorRed
+	case hue < 45:
+		if v < 0.6 {
+			return ColorBrown
+		}
+		return ColorOrange
+	case hue < 70:
+		return ColorYellow
+	case hue < 170:
+		return ColorGreen
+	case hue < 260:
+		return ColorBlue
+	case hue < 290:
+		return ColorPurple
+	default:
+		return ColorPink
+	}
+}
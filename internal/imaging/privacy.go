@@ -0,0 +1,90 @@
+package imaging
+
+// Metadata privacy levels (stored as-is in the database)
+const (
+	MetadataKeep          = "keep"
+	MetadataStripLocation = "strip_location"
+	MetadataStripAll      = "strip_all"
+)
+
+// ApplyMetadataPrivacy returns a copy of a JPEG with metadata removed
+// according to level. The input slice is never modified.
+func ApplyMetadataPrivacy(data []byte, level string) ([]byte, error) {
+	switch level {
+	case MetadataStripLocation:
+		return StripLocation(data)
+	case MetadataStripAll:
+		return StripAllMetadata(data)
+	default:
+		return data, nil
+	}
+}
+
+// StripLocation removes GPS coordinates from a JPEG. The Exif GPS directory
+// is wiped and XMP packets (which may duplicate the location) are dropped;
+// all other metadata is kept.
+func StripLocation(data []byte) ([]byte, error) {
+	segments, scan, err := splitSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := segments[:0:0]
+	for _, s := range segments {
+		switch {
+		case s.isXMP():
+			continue
+		case s.isExif():
+			payload := append([]byte(nil), s.Data...)
+			t, err := parseTIFF(payload)
+			if err != nil {
+				// Unparseable Exif can't be partially cleaned, so drop it
+				continue
+			}
+			if _, err := t.removeGPS(); err != nil {
+				continue
+			}
+			s.Data = payload
+		}
+		kept = append(kept, s)
+	}
+	return joinSegments(kept, scan), nil
+}
+
+// StripAllMetadata removes every metadata segment (Exif, XMP, IPTC,
+// comments) from a JPEG. Segments needed to render the image correctly,
+// such as JFIF, ICC color profiles and Adobe color transforms, are kept, as
+// is the Exif orientation.
+func StripAllMetadata(data []byte) ([]byte, error) {
+	segments, scan, err := splitSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	orientation := Orientation(data)
+
+	kept := segments[:0:0]
+	for _, s := range segments {
+		switch {
+		case s.Marker == markerCOM:
+			continue
+		case s.isAPP():
+			// Keep APP0 (JFIF), APP2 (ICC profile) and APP14 (Adobe)
+			if s.Marker != markerAPP0 && s.Marker != markerAPP2 && s.Marker != markerAPP14 {
+				continue
+			}
+		}
+		kept = append(kept, s)
+	}
+
+	// Orientation isn't sensitive, and dropping it would show the image sideways
+	if orientation != 1 {
+		at := 0
+		if len(kept) > 0 && kept[0].Marker == markerAPP0 {
+			at = 1
+		}
+		exif := segment{Marker: markerAPP1, Data: minimalExif(orientation)}
+		kept = append(kept[:at], append([]segment{exif}, kept[at:]...)...)
+	}
+	return joinSegments(kept, scan), nil
+}
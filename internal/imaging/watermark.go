@@ -0,0 +1,163 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png" // watermark logos may be PNG
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Watermark positions (stored as-is in the database)
+const (
+	WatermarkTopLeft     = "top_left"
+	WatermarkTopRight    = "top_right"
+	WatermarkBottomLeft  = "bottom_left"
+	WatermarkBottomRight = "bottom_right"
+	WatermarkCenter      = "center"
+)
+
+// Watermark limits
+const (
+	MaxWatermarkImageSize = 1024 * 1024
+	MaxWatermarkText      = 100
+	MinWatermarkScale     = 0.05
+)
+
+// maxWatermarkLogoSide bounds the longer side of a decoded logo. Larger
+// logos are shrunk once when decoded rather than on every render.
+const maxWatermarkLogoSide = 1024
+
+// watermarkMargin is the gap between a watermark and the image edges, as a
+// fraction of the image width
+const watermarkMargin = 0.02
+
+// Watermark is a text or logo overlay drawn on renditions served to
+// viewers other than the owner
+type Watermark struct {
+	Text     string      // drawn when Logo is nil
+	Logo     image.Image // see DecodeWatermarkLogo
+	Position string
+	Opacity  float64 // 0 to 1
+	Scale    float64 // watermark width as a fraction of the image width
+}
+
+// DecodeWatermarkLogo decodes a PNG or JPEG logo on one of the shared
+// decoder's workers, checking its size and dimensions first and shrinking
+// it to at most maxWatermarkLogoSide pixels. The result is meant to be
+// kept and reused across renders.
+func DecodeWatermarkLogo(ctx context.Context, data []byte) (image.Image, error) {
+	if len(data) > MaxWatermarkImageSize {
+		return nil, fmt.Errorf("%w: watermark image too large (max 1MB)", ErrInvalidImage)
+	}
+	if _, format, err := Validate(data); err != nil {
+		return nil, err
+	} else if format != "png" && format != "jpeg" {
+		return nil, fmt.Errorf("%w: watermark image must be PNG or JPEG", ErrInvalidImage)
+	}
+
+	var logo image.Image
+	err := std.run(ctx, func() error {
+		decoded, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidImage, err)
+		}
+		logo = shrinkLogo(decoded)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logo, nil
+}
+
+// shrinkLogo scales a logo down to fit maxWatermarkLogoSide, keeping its
+// aspect ratio
+func shrinkLogo(logo image.Image) image.Image {
+	b := logo.Bounds()
+	side := max(b.Dx(), b.Dy())
+	if side <= maxWatermarkLogoSide {
+		return logo
+	}
+	width := max(1, b.Dx()*maxWatermarkLogoSide/side)
+	height := max(1, b.Dy()*maxWatermarkLogoSide/side)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), logo, b, draw.Src, nil)
+	return dst
+}
+
+// applyWatermark returns a copy of img with the watermark drawn on it
+func applyWatermark(img image.Image, wm *Watermark) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Copy(dst, image.Point{}, img, b, draw.Src, nil)
+
+	mark := wm.Logo
+	if mark == nil {
+		mark = renderWatermarkText(wm.Text)
+	}
+	mb := mark.Bounds()
+	if mb.Dx() == 0 || mb.Dy() == 0 {
+		return dst
+	}
+
+	// Scale to the requested share of the image width, keeping the aspect
+	// ratio and never exceeding the image
+	width := int(float64(b.Dx()) * wm.Scale)
+	height := width * mb.Dy() / mb.Dx()
+	if height > b.Dy() {
+		height = b.Dy()
+		width = height * mb.Dx() / mb.Dy()
+	}
+	if width < 1 || height < 1 {
+		return dst
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), mark, mb, draw.Src, nil)
+
+	margin := int(float64(b.Dx()) * watermarkMargin)
+	var at image.Point
+	switch wm.Position {
+	case WatermarkTopLeft:
+		at = image.Pt(margin, margin)
+	case WatermarkTopRight:
+		at = image.Pt(b.Dx()-width-margin, margin)
+	case WatermarkBottomLeft:
+		at = image.Pt(margin, b.Dy()-height-margin)
+	case WatermarkCenter:
+		at = image.Pt((b.Dx()-width)/2, (b.Dy()-height)/2)
+	default:
+		at = image.Pt(b.Dx()-width-margin, b.Dy()-height-margin)
+	}
+
+	mask := image.NewUniform(color.Alpha{A: clamp8(wm.Opacity * 255)})
+	draw.DrawMask(dst, image.Rectangle{Min: at, Max: at.Add(image.Pt(width, height))}, scaled, image.Point{}, mask, image.Point{}, draw.Over)
+	return dst
+}
+
+// renderWatermarkText draws text in white with a dark outline so it stays
+// legible on any background. It is drawn small and scaled up by the caller.
+func renderWatermarkText(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil() + 2
+	height := face.Metrics().Height.Ceil() + 2
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	d := font.Drawer{Dst: img, Face: face}
+	baseline := face.Metrics().Ascent.Ceil() + 1
+	for _, off := range []image.Point{{0, 1}, {2, 1}, {1, 0}, {1, 2}} {
+		d.Src = image.NewUniform(color.RGBA{A: 160})
+		d.Dot = fixed.P(off.X, baseline+off.Y-1)
+		d.DrawString(text)
+	}
+	d.Src = image.White
+	d.Dot = fixed.P(1, baseline)
+	d.DrawString(text)
+	return img
+}
@@ -0,0 +1,168 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"golang.org/x/image/draw"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+	"github.com/mzzz-zzm/galleryblue/internal/imaging"
+	"github.com/mzzz-zzm/galleryblue/internal/similarity"
+)
+
+const thumbnailMaxWidth = 300
+const thumbnailMaxHeight = 200
+const thumbnailQuality = 70
+
+// ThumbnailSpec identifies the current thumbnail settings. It is stored with
+// each image so images processed under older settings can be found and
+// regenerated.
+var ThumbnailSpec = fmt.Sprintf("%dx%dq%d", thumbnailMaxWidth, thumbnailMaxHeight, thumbnailQuality)
+
+// ProcessImagePayload is the JSON payload of a process_image job
+type ProcessImagePayload struct {
+	// NormalizeOrientation rewrites the stored original so its pixels are upright
+	NormalizeOrientation bool `json:"normalize_orientation,omitempty"`
+}
+
+// generateThumbnail creates a smaller version of an upright image for gallery display
+func generateThumbnail(img image.Image, maxWidth, maxHeight int) ([]byte, error) {
+	bounds := img.Bounds()
+	origWidth := bounds.Dx()
+	origHeight := bounds.Dy()
+
+	// Calculate new dimensions maintaining aspect ratio
+	newWidth := maxWidth
+	newHeight := maxHeight
+
+	widthRatio := float64(maxWidth) / float64(origWidth)
+	heightRatio := float64(maxHeight) / float64(origHeight)
+
+	if widthRatio < heightRatio {
+		newHeight = int(float64(origHeight) * widthRatio)
+	} else {
+		newWidth = int(float64(origWidth) * heightRatio)
+	}
+
+	// Create thumbnail
+	thumbnail := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	// Encode as JPEG
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// processImage runs a process_image job
+func processImage(ctx context.Context, job *db.Job) error {
+	var payload ProcessImagePayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return Permanent(fmt.Errorf("invalid payload: %w", err))
+	}
+	return ProcessImage(ctx, job.ImageID, payload)
+}
+
+// ProcessImage generates an image's derivatives: the optionally normalized
+// original, and the thumbnail, upright dimensions, perceptual hash and
+// placeholders (BlurHash, LQIP and color palette) of the image with its
+// edit recipe applied
+func ProcessImage(ctx context.Context, imageID string, payload ProcessImagePayload) error {
+	img, err := db.GetImageByID(ctx, imageID)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		// Deleted while queued; nothing to do
+		return nil
+	}
+	if err := db.SetImageProcessing(ctx, img.ID); err != nil {
+		return err
+	}
+
+	var normalized []byte
+	data := img.Data
+	if payload.NormalizeOrientation && imaging.Orientation(data) != 1 {
+		normalized, err = imaging.NormalizeOrientation(ctx, data)
+		if err != nil {
+			return classify(err)
+		}
+		data = normalized
+	}
+
+	decoded, err := imaging.Decode(ctx, data)
+	if err != nil {
+		return classify(err)
+	}
+	var edits []imaging.Edit
+	if len(img.Edits) > 0 {
+		if err := json.Unmarshal(img.Edits, &edits); err != nil {
+			return Permanent(fmt.Errorf("invalid edit recipe: %w", err))
+		}
+		if decoded, err = imaging.ApplyEdits(decoded, edits); err != nil {
+			return classify(err)
+		}
+	}
+	thumbnail, err := generateThumbnail(decoded, thumbnailMaxWidth, thumbnailMaxHeight)
+	if err != nil {
+		return classify(err)
+	}
+	phash := imaging.DHash(decoded)
+
+	cfg, _, err := imaging.Validate(data)
+	if err != nil {
+		return classify(err)
+	}
+	width, height := cfg.Width, cfg.Height
+	if o := imaging.Orientation(data); o >= 5 {
+		width, height = height, width
+	}
+	if len(edits) > 0 {
+		width, height = decoded.Bounds().Dx(), decoded.Bounds().Dy()
+	}
+
+	lqip, err := imaging.LQIP(decoded)
+	if err != nil {
+		return err
+	}
+	derivatives := db.Derivatives{
+		Data:          normalized,
+		Thumbnail:     thumbnail,
+		ThumbnailSpec: ThumbnailSpec,
+		Width:         width,
+		Height:        height,
+		PHash:         phash,
+		BlurHash:      imaging.BlurHash(decoded),
+		LQIP:          lqip,
+	}
+	for i, c := range imaging.Palette(decoded) {
+		if i == 0 {
+			derivatives.DominantColor = imaging.ColorName(c)
+		}
+		derivatives.Palette = append(derivatives.Palette, imaging.HexColor(c))
+	}
+
+	if err := db.SaveImageDerivatives(ctx, img.ID, img.ContentVersion, img.Edits, derivatives); err != nil {
+		return err
+	}
+	similarity.Add(img.ID, phash)
+	return nil
+}
+
+// classify marks imaging errors that will never succeed as permanent
+func classify(err error) error {
+	if errors.Is(err, imaging.ErrInvalidImage) || errors.Is(err, imaging.ErrImageTooLarge) ||
+		errors.Is(err, imaging.ErrInvalidEdit) {
+		return Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+)
+
+const (
+	defaultWorkers = 2
+	pollInterval   = time.Second
+	jobLease       = 5 * time.Minute
+	baseBackoff    = 10 * time.Second
+	maxBackoff     = time.Hour
+)
+
+// Handler runs a single job. Returning an error retries the job with
+// backoff; wrap it with Permanent to dead-letter the job immediately.
+type Handler func(ctx context.Context, job *db.Job) error
+
+var handlers = map[string]Handler{
+	db.JobProcessImage: processImage,
+}
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the job is dead-lettered without further retries
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// isPermanent reports whether err was wrapped with Permanent
+func isPermanent(err error) bool {
+	var perm permanentError
+	return errors.As(err, &perm)
+}
+
+// Start launches the worker pool and the trash sweeper. The number of
+// workers is read from JOB_WORKERS (default 2) and the trash retention from
+// TRASH_RETENTION_DAYS (default 30). Both stop when ctx is cancelled.
+func Start(ctx context.Context) error {
+	workers := defaultWorkers
+	if v := os.Getenv("JOB_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid JOB_WORKERS: %q", v)
+		}
+		workers = n
+	}
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid TRASH_RETENTION_DAYS: %q", v)
+		}
+		trashRetention = time.Duration(n) * 24 * time.Hour
+	}
+
+	for i := 0; i < workers; i++ {
+		go work(ctx)
+	}
+	go sweepTrash(ctx)
+	return nil
+}
+
+// work claims and runs jobs until ctx is cancelled, sleeping while the
+// queue is empty
+func work(ctx context.Context) {
+	for {
+		job, err := db.ClaimJob(ctx, jobLease)
+		if err != nil {
+			log.Printf("jobs: failed to claim job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		run(ctx, job)
+	}
+}
+
+// run executes a claimed job and records the outcome
+func run(ctx context.Context, job *db.Job) {
+	handler, ok := handlers[job.Kind]
+	if !ok {
+		fail(ctx, job, Permanent(fmt.Errorf("unknown job kind %q", job.Kind)))
+		return
+	}
+
+	if err := handler(ctx, job); err != nil {
+		fail(ctx, job, err)
+		return
+	}
+	if err := db.CompleteJob(ctx, job.ID); err != nil {
+		log.Printf("jobs: failed to complete job %s: %v", job.ID, err)
+	}
+}
+
+// fail retries a job with exponential backoff, or dead-letters it once it
+// is out of attempts or the error is permanent
+func fail(ctx context.Context, job *db.Job, err error) {
+	if isPermanent(err) || job.Attempts >= job.MaxAttempts {
+		log.Printf("jobs: %s job %s failed permanently: %v", job.Kind, job.ID, err)
+		if err := db.KillJob(ctx, job.ID, err.Error()); err != nil {
+			log.Printf("jobs: failed to dead-letter job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	delay := baseBackoff << (job.Attempts - 1)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	log.Printf("jobs: %s job %s failed (attempt %d/%d), retrying in %s: %v",
+		job.Kind, job.ID, job.Attempts, job.MaxAttempts, delay, err)
+	if err := db.RetryJob(ctx, job.ID, err.Error(), delay); err != nil {
+		log.Printf("jobs: failed to reschedule job %s: %v", job.ID, err)
+	}
+}
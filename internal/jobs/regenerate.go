@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"context"
+	"log"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+)
+
+const defaultRegenerateBatch = 100
+
+// RegenerateOptions selects which images to re-process and how
+type RegenerateOptions struct {
+	Filter    db.RegenerateFilter
+	BatchSize int
+	// DryRun walks the matching images without processing or queueing them
+	DryRun bool
+	// Inline processes images in the calling process instead of queueing
+	// jobs for the server's workers
+	Inline bool
+}
+
+// RegenerateProgress is reported after every batch
+type RegenerateProgress struct {
+	Total  int    // images matching the filter when the run started
+	Done   int    // images processed (or queued) so far
+	Failed int    // images that failed to process inline; see Regenerate
+	Cursor string // last image ID handled; pass as Filter.After to resume
+}
+
+// Regenerate re-processes the derivatives of all images matching the
+// filter, in ID order and in batches. report is called after each batch; a
+// non-nil error from it stops the run. The returned progress carries the
+// cursor to resume from if the run is interrupted.
+//
+// Inline failures only mark an image failed when retrying cannot help;
+// after a transient error (a busy decoder, a database hiccup) the image
+// keeps its existing derivatives and is queued for the server's workers.
+func Regenerate(ctx context.Context, opts RegenerateOptions, report func(RegenerateProgress) error) (RegenerateProgress, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultRegenerateBatch
+	}
+
+	var progress RegenerateProgress
+	progress.Cursor = opts.Filter.After
+
+	total, err := db.CountImagesForRegeneration(ctx, opts.Filter)
+	if err != nil {
+		return progress, err
+	}
+	progress.Total = total
+
+	filter := opts.Filter
+	for {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+
+		filter.After = progress.Cursor
+		ids, err := db.ListImagesForRegeneration(ctx, filter, opts.BatchSize)
+		if err != nil {
+			return progress, err
+		}
+		if len(ids) == 0 {
+			return progress, nil
+		}
+
+		switch {
+		case opts.DryRun:
+		case opts.Inline:
+			for _, id := range ids {
+				err := ProcessImage(ctx, id, ProcessImagePayload{})
+				if err == nil {
+					continue
+				}
+				if ctx.Err() != nil {
+					// Hand the interrupted image to the workers rather
+					// than leaving it marked as processing
+					if _, err := db.EnqueueImageProcessing(context.WithoutCancel(ctx), []string{id}); err != nil {
+						log.Printf("regenerate: failed to queue image %s: %v", id, err)
+					}
+					return progress, ctx.Err()
+				}
+				log.Printf("regenerate: image %s failed: %v", id, err)
+				progress.Failed++
+				if isPermanent(err) {
+					err = db.SetImageFailed(ctx, id, err.Error())
+				} else {
+					_, err = db.EnqueueImageProcessing(ctx, []string{id})
+				}
+				if err != nil {
+					return progress, err
+				}
+			}
+		default:
+			if _, err := db.EnqueueImageProcessing(ctx, ids); err != nil {
+				return progress, err
+			}
+		}
+
+		progress.Done += len(ids)
+		progress.Cursor = ids[len(ids)-1]
+		if report != nil {
+			if err := report(progress); err != nil {
+				return progress, err
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+)
+
+const (
+	defaultTrashRetention = 30 * 24 * time.Hour
+	sweepInterval         = time.Hour
+	purgeBatchSize        = 500
+)
+
+// trashRetention is how long images stay in the trash; set by Start
+var trashRetention = defaultTrashRetention
+
+// TrashRetention returns how long trashed images are kept before the
+// sweeper deletes them permanently
+func TrashRetention() time.Duration {
+	return trashRetention
+}
+
+// sweepTrash purges images trashed longer than the retention period every
+// sweepInterval until ctx is cancelled
+func sweepTrash(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		purgeExpiredTrash(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeExpiredTrash deletes expired trash in batches so no single
+// transaction holds many rows
+func purgeExpiredTrash(ctx context.Context) {
+	cutoff := time.Now().Add(-trashRetention)
+	total := 0
+	for ctx.Err() == nil {
+		n, err := db.PurgeTrash(ctx, "", &cutoff, purgeBatchSize)
+		if err != nil {
+			log.Printf("jobs: failed to purge trash: %v", err)
+			return
+		}
+		total += n
+		if n < purgeBatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		log.Printf("jobs: purged %d trashed images", total)
+	}
+}
@@ -0,0 +1,86 @@
+// Package markup cleans and renders the small Markdown subset allowed in
+// comments: **bold**, *italic*, `code`, [links](https://...) and line breaks.
+// Everything else, including raw HTML, is shown as typed.
+package markup
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	// blankLines matches runs of blank lines, which Clean collapses to one
+	blankLines = regexp.MustCompile(`\n{3,}`)
+	// token matches spans whose content isn't formatted further: a code
+	// span (group 1) or a link's text (group 2) and http(s) URL (group 3)
+	token    = regexp.MustCompile("`([^`\n]+)`" + `|\[([^\[\]\n]+)\]\((https?://[^\s()]+)\)`)
+	bold     = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	emphasis = regexp.MustCompile(`\*([^*\n]+)\*`)
+)
+
+// Clean normalizes text for storage: line endings become "\n", other
+// control characters and bidi overrides are dropped, trailing spaces and
+// surrounding blank lines are trimmed, and blank lines are collapsed
+func Clean(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			return -1
+		}
+		return r
+	}, s)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+	s = strings.Trim(strings.Join(lines, "\n"), "\n")
+	return blankLines.ReplaceAllString(s, "\n\n")
+}
+
+// Render converts cleaned text to HTML. Blank lines separate paragraphs
+// and single newlines become line breaks. Links open outside the site and
+// carry rel="nofollow ugc" so they earn spammers nothing.
+func Render(s string) string {
+	var b strings.Builder
+	for _, para := range strings.Split(s, "\n\n") {
+		if para == "" {
+			continue
+		}
+		b.WriteString("<p>")
+		for i, line := range strings.Split(para, "\n") {
+			if i > 0 {
+				b.WriteString("<br>")
+			}
+			renderLine(&b, html.EscapeString(line))
+		}
+		b.WriteString("</p>")
+	}
+	return b.String()
+}
+
+// renderLine writes an escaped line with its inline formatting applied
+func renderLine(b *strings.Builder, line string) {
+	last := 0
+	for _, m := range token.FindAllStringSubmatchIndex(line, -1) {
+		b.WriteString(formatText(line[last:m[0]]))
+		if m[2] >= 0 {
+			b.WriteString("<code>" + line[m[2]:m[3]] + "</code>")
+		} else {
+			b.WriteString(`<a href="` + line[m[6]:m[7]] + `" rel="nofollow ugc noopener" target="_blank">` +
+				formatText(line[m[4]:m[5]]) + "</a>")
+		}
+		last = m[1]
+	}
+	b.WriteString(formatText(line[last:]))
+}
+
+// formatText applies bold and italic to escaped text
+func formatText(s string) string {
+	s = bold.ReplaceAllString(s, "<strong>$1</strong>")
+	return emphasis.ReplaceAllString(s, "<em>$1</em>")
+}
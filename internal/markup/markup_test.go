@@ -0,0 +1,82 @@
+package markup
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	const rel = `" rel="nofollow ugc noopener" target="_blank">`
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		// Escaping
+		{"plain", "hello", "<p>hello</p>"},
+		{"script tag", `<script>alert("x")</script>`, "<p>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</p>"},
+		{"attribute html", `<img src=x onerror='alert(1)'>`, "<p>&lt;img src=x onerror=&#39;alert(1)&#39;&gt;</p>"},
+		{"ampersand", "a & b", "<p>a &amp; b</p>"},
+		{"entity", "&lt;b&gt;", "<p>&amp;lt;b&amp;gt;</p>"},
+		{"html in code", "`<b>`", "<p><code>&lt;b&gt;</code></p>"},
+		{"html in bold", "**<i>x</i>**", "<p><strong>&lt;i&gt;x&lt;/i&gt;</strong></p>"},
+
+		// Paragraphs and line breaks
+		{"line break", "a\nb", "<p>a<br>b</p>"},
+		{"paragraphs", "a\n\nb", "<p>a</p><p>b</p>"},
+		{"empty", "", ""},
+
+		// Links
+		{"https link", "[site](https://example.com/a)", `<p><a href="https://example.com/a` + rel + "site</a></p>"},
+		{"http link", "[site](http://example.com)", `<p><a href="http://example.com` + rel + "site</a></p>"},
+		{"query string", "[q](https://example.com/?a=1&b=2)", `<p><a href="https://example.com/?a=1&amp;b=2` + rel + "q</a></p>"},
+		{"formatted link text", "[*hi*](https://example.com)", `<p><a href="https://example.com` + rel + "<em>hi</em></a></p>"},
+		{"javascript scheme", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"mixed case javascript", "[x](JaVaScRiPt:alert(1))", "<p>[x](JaVaScRiPt:alert(1))</p>"},
+		{"data scheme", "[x](data:text/html;base64,PHNjcmlwdD4=)", "<p>[x](data:text/html;base64,PHNjcmlwdD4=)</p>"},
+		{"vbscript scheme", "[x](vbscript:msgbox)", "<p>[x](vbscript:msgbox)</p>"},
+		{"upper case https", "[x](HTTPS://example.com)", "<p>[x](HTTPS://example.com)</p>"},
+		{"scheme relative", "[x](//example.com)", "<p>[x](//example.com)</p>"},
+		{"space in url", "[x](https://example.com/ onclick=alert)", "<p>[x](https://example.com/ onclick=alert)</p>"},
+		{"bare url", "https://example.com", "<p>https://example.com</p>"},
+
+		// Quote and attribute injection
+		{"double quote in url", `[x](https://example.com/"onmouseover="alert)`,
+			`<p><a href="https://example.com/&#34;onmouseover=&#34;alert` + rel + "x</a></p>"},
+		{"single quote in url", `[x](https://example.com/'onmouseover='alert)`,
+			`<p><a href="https://example.com/&#39;onmouseover=&#39;alert` + rel + "x</a></p>"},
+		{"tag in url", `[x](https://example.com/"><script>)`,
+			`<p><a href="https://example.com/&#34;&gt;&lt;script&gt;` + rel + "x</a></p>"},
+		{"quotes in link text", `["a" 'b' <c>](https://example.com)`,
+			`<p><a href="https://example.com` + rel + "&#34;a&#34; &#39;b&#39; &lt;c&gt;</a></p>"},
+
+		// Nested and unclosed markers
+		{"bold", "**b**", "<p><strong>b</strong></p>"},
+		{"italic", "*i*", "<p><em>i</em></p>"},
+		{"bold inside italic", "*a **b** c*", "<p><em>a <strong>b</strong> c</em></p>"},
+		{"unclosed bold", "**bold", "<p>**bold</p>"},
+		{"unclosed italic", "*it", "<p>*it</p>"},
+		{"unclosed code", "`code", "<p>`code</p>"},
+		{"unclosed link text", "[x(https://example.com)", "<p>[x(https://example.com)</p>"},
+		{"unclosed link url", "[x](https://example.com", "<p>[x](https://example.com</p>"},
+		{"markers across lines", "**a\nb**", "<p>**a<br>b**</p>"},
+		{"markers across paragraphs", "*a\n\nb*", "<p>*a</p><p>b*</p>"},
+		{"no formatting in code", "`**x** [y](https://example.com)`", "<p><code>**x** [y](https://example.com)</code></p>"},
+		{"code in link text", "[`x`](https://example.com)", `<p><a href="https://example.com` + rel + "`x`</a></p>"},
+		{"link in link text", "[[x](https://a.com)](https://b.com)", `<p>[<a href="https://a.com` + rel + "x</a>](https://b.com)</p>"},
+
+		// Mentions aren't a feature: they stay literal text
+		{"mention", "@alice", "<p>@alice</p>"},
+		{"mention with comma", "@alice, hi", "<p>@alice, hi</p>"},
+		{"mention with period", "thanks @bob.", "<p>thanks @bob.</p>"},
+		{"mention in parens", "(@carol)", "<p>(@carol)</p>"},
+		{"mention in angle brackets", "<@dave>", "<p>&lt;@dave&gt;</p>"},
+		{"mention in bold", "**@erin**!", "<p><strong>@erin</strong>!</p>"},
+		{"email", "me@example.com", "<p>me@example.com</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.in); got != tt.want {
+				t.Errorf("Render(%q) =\n  %s\nwant\n  %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package similarity
+
+import (
+	"github.com/mzzz-zzm/galleryblue/internal/imaging"
+)
+
+// Match is an image found within the search distance
+type Match struct {
+	ImageID  string
+	Distance int
+}
+
+// node holds every image sharing one hash. Children are keyed by their
+// Hamming distance from this node's hash.
+type node struct {
+	hash     uint64
+	ids      []string
+	children map[int]*node
+}
+
+// BKTree is a metric tree over 64-bit perceptual hashes. Searching for
+// hashes within distance d only visits subtrees whose edge distance lies in
+// [k-d, k+d], where k is the query's distance from the node, so lookups
+// touch a small fraction of the tree for the small thresholds used for
+// near-duplicate detection. A BKTree is not safe for concurrent use.
+type BKTree struct {
+	root *node
+	size int
+}
+
+// Len returns the number of image IDs in the tree
+func (t *BKTree) Len() int {
+	return t.size
+}
+
+// Add inserts an image's hash
+func (t *BKTree) Add(hash uint64, imageID string) {
+	t.size++
+	if t.root == nil {
+		t.root = &node{hash: hash, ids: []string{imageID}}
+		return
+	}
+
+	n := t.root
+	for {
+		d := imaging.HammingDistance(hash, n.hash)
+		if d == 0 {
+			n.ids = append(n.ids, imageID)
+			return
+		}
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[int]*node)
+			}
+			n.children[d] = &node{hash: hash, ids: []string{imageID}}
+			return
+		}
+		n = child
+	}
+}
+
+// Search returns every image whose hash is within maxDistance of hash
+func (t *BKTree) Search(hash uint64, maxDistance int) []Match {
+	if t.root == nil {
+		return nil
+	}
+
+	var matches []Match
+	stack := []*node{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := imaging.HammingDistance(hash, n.hash)
+		if d <= maxDistance {
+			for _, id := range n.ids {
+				matches = append(matches, Match{ImageID: id, Distance: d})
+			}
+		}
+		// By the triangle inequality, matches under a child at edge
+		// distance k must satisfy |k-d| <= maxDistance
+		for k, child := range n.children {
+			if k >= d-maxDistance && k <= d+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+	return matches
+}
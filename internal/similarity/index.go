@@ -0,0 +1,113 @@
+// Package similarity finds visually similar images by perceptual hash
+package similarity
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mzzz-zzm/galleryblue/internal/db"
+)
+
+// refreshInterval bounds how long the index can miss hashes written by
+// other server instances
+const refreshInterval = 10 * time.Minute
+
+type entry struct {
+	hash    uint64
+	imageID string
+}
+
+// index is the process-wide BK-tree of image hashes. It is loaded from the
+// database on first use and rebuilt every refreshInterval; hashes computed
+// in this process are added as they are stored. Entries for deleted or
+// re-hashed images linger until the next rebuild (and an image may appear
+// twice), so callers must verify matches against the database.
+var index struct {
+	mu       sync.RWMutex
+	tree     *BKTree
+	loadedAt time.Time
+	// pending collects hashes added while a rebuild is in progress, which
+	// the rebuild's snapshot may have missed
+	pending []entry
+	loading bool
+
+	loadMu sync.Mutex // serializes rebuilds
+}
+
+// Add records an image's hash
+func Add(imageID string, hash uint64) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if index.tree != nil {
+		index.tree.Add(hash, imageID)
+	}
+	if index.loading {
+		index.pending = append(index.pending, entry{hash, imageID})
+	}
+}
+
+// Search returns candidate images whose hash is within maxDistance of hash
+func Search(ctx context.Context, hash uint64, maxDistance int) ([]Match, error) {
+	if err := ensureFresh(ctx); err != nil {
+		return nil, err
+	}
+
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	return index.tree.Search(hash, maxDistance), nil
+}
+
+// ensureFresh loads the index if it is missing or stale. A stale index
+// keeps serving searches while a single caller rebuilds it.
+func ensureFresh(ctx context.Context) error {
+	index.mu.RLock()
+	loaded := index.tree != nil
+	stale := time.Since(index.loadedAt) > refreshInterval
+	index.mu.RUnlock()
+	if loaded && !stale {
+		return nil
+	}
+
+	if loaded {
+		if !index.loadMu.TryLock() {
+			return nil // another caller is already rebuilding
+		}
+	} else {
+		index.loadMu.Lock()
+	}
+	defer index.loadMu.Unlock()
+
+	index.mu.Lock()
+	if index.tree != nil && time.Since(index.loadedAt) <= refreshInterval {
+		index.mu.Unlock()
+		return nil
+	}
+	index.loading = true
+	index.pending = nil
+	index.mu.Unlock()
+
+	tree := &BKTree{}
+	err := db.ForEachImageHash(ctx, func(imageID string, hash uint64) {
+		tree.Add(hash, imageID)
+	})
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.loading = false
+	if err != nil {
+		index.pending = nil
+		if index.tree != nil {
+			return nil // keep serving the stale index; the next search retries
+		}
+		return err
+	}
+	for _, e := range index.pending {
+		tree.Add(e.hash, e.imageID)
+	}
+	index.pending = nil
+	index.tree = tree
+	index.loadedAt = time.Now()
+	return nil
+}